@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// amiCacheTTL is how long a looked up AMI is reused before it is looked up again
+const amiCacheTTL = 24 * time.Hour
+
+// amiCacheEntry is an AMI looked up for a region, image and architecture
+type amiCacheEntry struct {
+	AMI       string    `json:"ami"`
+	Source    string    `json:"source"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// amiCache holds the looked up AMIs keyed by region/image/arch
+type amiCache map[string]amiCacheEntry
+
+// amiCachePath returns the path of the AMI cache shared by every cluster
+func amiCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory, %v", err)
+	}
+	return filepath.Join(home, ".k3sdeploy", "ami-cache.json"), nil
+}
+
+// loadAMICache reads the AMI cache, returning an empty cache if there is none
+func loadAMICache(path string) (amiCache, error) {
+	cache := amiCache{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, fmt.Errorf("failed to read AMI cache %q, %v", path, err)
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return amiCache{}, fmt.Errorf("failed to parse AMI cache %q, %v", path, err)
+	}
+	return cache, nil
+}
+
+// save writes the AMI cache, replacing it atomically so a crash never leaves it truncated
+func (c amiCache) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode AMI cache, %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory of AMI cache %q, %v", path, err)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write AMI cache %q, %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write AMI cache %q, %v", path, err)
+	}
+	return nil
+}
+
+// lookupAMI returns the latest AMI of the cluster image for arch in the region of awscfg.
+// It reads the AWS published SSM parameter of the image where there is one, falling back
+// to searching DescribeImages, and reuses an AMI looked up less than amiCacheTTL ago. A
+// broken cache is only logged since the AMI can always be looked up again.
+func lookupAMI(awscfg aws.Config, k3scfg *cfg, arch string) (string, error) {
+	image := osImages[k3scfg.image]
+	key := awscfg.Region + "/" + k3scfg.image + "/" + arch
+
+	path, err := amiCachePath()
+	if err != nil {
+		log.Printf("ignoring AMI cache, %v", err)
+	}
+	cache := amiCache{}
+	if path != "" {
+		if cache, err = loadAMICache(path); err != nil {
+			log.Printf("ignoring AMI cache, %v", err)
+		}
+	}
+	if v, ok := cache[key]; ok && time.Since(v.FetchedAt) < amiCacheTTL {
+		log.Printf("Found %s AMI %q for %s cached from %s at %s\n", k3scfg.image, v.AMI, arch, v.Source, v.FetchedAt.Format(time.RFC3339))
+		return v.AMI, nil
+	}
+
+	var id, source string
+	if param, ok := image.ssmParameters[arch]; ok {
+		if id, err = ssmAMI(ssm.NewFromConfig(awscfg), param); err != nil {
+			log.Printf("falling back to DescribeImages, %v", err)
+		} else {
+			source = "SSM parameter " + param
+		}
+	}
+	if id == "" {
+		if id, err = describeAMI(ec2.NewFromConfig(awscfg), image, arch); err != nil {
+			return "", err
+		}
+		source = "DescribeImages " + image.namePattern
+	}
+	log.Printf("Found %s AMI %q for %s from %s\n", k3scfg.image, id, arch, source)
+
+	if path != "" {
+		cache[key] = amiCacheEntry{AMI: id, Source: source, FetchedAt: time.Now().UTC()}
+		if err := cache.save(path); err != nil {
+			log.Printf("failed to cache AMI, %v", err)
+		}
+	}
+	return id, nil
+}
+
+// resolveAMIs finds the AMI of every architecture of the cluster, the set AMI or the latest
+// one of the image, keeping the ones of the deploy being resumed so every node matches. Each
+// AMI is checked to be of its architecture and to fit the root volumes.
+func resolveAMIs(awscfg aws.Config, k3scfg *cfg, state *clusterState) error {
+	client := ec2.NewFromConfig(awscfg)
+	k3scfg.amis = map[string]string{}
+	k3scfg.rootDevices = map[string]string{}
+
+	for _, arch := range clusterArchs(k3scfg) {
+		id := state.AMIs[arch]
+		// deploys from before architectures were recorded only ran x86_64
+		if id == "" && len(state.AMIs) == 0 && arch == defaultArch {
+			id = state.AMI
+		}
+		if id == "" {
+			id = k3scfg.ami
+		}
+		if id == "" {
+			var err error
+			if id, err = lookupAMI(awscfg, k3scfg, arch); err != nil {
+				return err
+			}
+		}
+
+		// the root volumes are mapped to the root device of the AMI and can't be smaller than it
+		device, amiArch, minSize, err := describeRootDevice(client, id)
+		if err != nil {
+			return err
+		}
+		if amiArch != arch {
+			return fmt.Errorf("AMI %q is %s, not the %s of the instances launched from it", id, amiArch, arch)
+		}
+		if err := valRootVolumes(k3scfg, id, minSize); err != nil {
+			return err
+		}
+
+		k3scfg.amis[arch] = id
+		k3scfg.rootDevices[arch] = device
+		log.Printf("Using %s %s AMI %q with ssh user %q\n", k3scfg.image, arch, id, k3scfg.sshUser)
+	}
+
+	state.update(func(s *clusterState) {
+		s.AMI = k3scfg.amis[k3scfg.arch]
+		s.AMIs = k3scfg.amis
+		s.Image = k3scfg.image
+		s.SSHUser = k3scfg.sshUser
+	})
+	return nil
+}
+
+// ssmAMI returns the AMI id held by the public SSM parameter name
+func ssmAMI(client *ssm.Client, name string) (string, error) {
+	result, err := client.GetParameter(context.TODO(), &ssm.GetParameterInput{Name: &name})
+	if err != nil {
+		return "", fmt.Errorf("failed to get SSM parameter %q, %v", name, err)
+	}
+	if result.Parameter == nil || !amiID.MatchString(aws.ToString(result.Parameter.Value)) {
+		return "", fmt.Errorf("SSM parameter %q doesn't hold an AMI id", name)
+	}
+	return *result.Parameter.Value, nil
+}
+
+// imagesPageSize is the number of images read per DescribeImages page
+const imagesPageSize = 1000
+
+// describeAMI searches the images of the owner of image for the latest available release of
+// image for arch, reading every page of matches
+func describeAMI(client *ec2.Client, image osImage, arch string) (string, error) {
+	// inputs
+	var name = "name"
+	var state = "state"
+	var architecture = "architecture"
+	var platform = "platform-details"
+
+	imagesInput := &ec2.DescribeImagesInput{
+		Owners:     []string{image.owner},
+		MaxResults: aws.Int32(imagesPageSize),
+		Filters: []types.Filter{
+			{
+				Name:   &name,
+				Values: []string{image.namePattern},
+			},
+			{
+				Name:   &state,
+				Values: []string{"available"},
+			},
+			{
+				Name:   &architecture,
+				Values: []string{arch},
+			},
+			{
+				Name:   &platform,
+				Values: []string{"Linux/UNIX"},
+			},
+		},
+	}
+
+	// get the ami with the latest creation date, skipping any without a parsable date
+	var latest string
+	var latestCreated time.Time
+	paginator := ec2.NewDescribeImagesPaginator(client, imagesInput)
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return "", fmt.Errorf("failed to get latest AMI ID of %q, %v", image.namePattern, err)
+		}
+		for _, v := range result.Images {
+			created, err := time.Parse(time.RFC3339, aws.ToString(v.CreationDate))
+			if err != nil || v.ImageId == nil {
+				continue
+			}
+			if latest == "" || created.After(latestCreated) {
+				latest, latestCreated = *v.ImageId, created
+			}
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no %s AMI found matching %q", arch, image.namePattern)
+	}
+	return latest, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"io"
@@ -12,7 +13,7 @@ import (
 )
 
 // createBastionSGRules creates the needed rules on the bastion SG
-func createBastionSGRules(client *ec2.Client, id, pubIP string) {
+func createBastionSGRules(client *ec2.Client, id, pubIP string) error {
 
 	// ingress rules
 	proto := "TCP"
@@ -30,9 +31,10 @@ func createBastionSGRules(client *ec2.Client, id, pubIP string) {
 			ToPort:     &endPorts[i],
 		}
 
+		// rules already exist when resuming a deploy
 		_, err := client.AuthorizeSecurityGroupIngress(context.TODO(), sgIngressInput)
-		if err != nil {
-			log.Fatalf("failed to create ingress security group rule, %v", err)
+		if err != nil && !isAPIError(err, "InvalidPermission.Duplicate") {
+			return fmt.Errorf("failed to create ingress security group rule, %v", err)
 		}
 	}
 
@@ -61,14 +63,15 @@ func createBastionSGRules(client *ec2.Client, id, pubIP string) {
 		}
 
 		_, err := client.AuthorizeSecurityGroupEgress(context.TODO(), sgEgressInput)
-		if err != nil {
-			log.Fatalf("failed to create egress security group rule, %v", err)
+		if err != nil && !isAPIError(err, "InvalidPermission.Duplicate") {
+			return fmt.Errorf("failed to create egress security group rule, %v", err)
 		}
 	}
+	return nil
 }
 
 // getPublicSubnets returns the ID of a public subnet in the VPC
-func getPublicSubnets(client *ec2.Client, k3scfg *cfg, vpcID string) (ids []string) {
+func getPublicSubnets(client *ec2.Client, k3scfg *cfg, vpcID string) (ids []string, err error) {
 	// inputs for describe subnets
 	var filterState = "state"
 	var filterVPC = "vpc-id"
@@ -89,7 +92,7 @@ func getPublicSubnets(client *ec2.Client, k3scfg *cfg, vpcID string) (ids []stri
 	// error if subnet is not found
 	result, err := client.DescribeSubnets(context.TODO(), subnetsInput)
 	if err != nil {
-		log.Fatalf("failed to describe subnet, %v", err)
+		return nil, fmt.Errorf("failed to describe subnet, %v", err)
 	}
 	for _, v := range result.Subnets {
 		if *v.MapPublicIpOnLaunch && *v.AvailableIpAddressCount >= 1 {
@@ -99,23 +102,23 @@ func getPublicSubnets(client *ec2.Client, k3scfg *cfg, vpcID string) (ids []stri
 
 	// bail if no subnets map public ips and there isnt an available address
 	if len(ids) < 1 {
-		log.Fatalf("unable to determine public subnet to use for bastion, %v", err)
+		return nil, fmt.Errorf("unable to determine public subnet to use for bastion in VPC %q", vpcID)
 	}
 
-	return ids
+	return ids, nil
 }
 
 // getIP returns public IP address as string
-func getIP() string {
+func getIP() (string, error) {
 	r, err := http.Get("http://ip-api.com/json/")
 	if err != nil {
-		log.Fatalf("failed to lookup IP address, %v", err)
+		return "", fmt.Errorf("failed to lookup IP address, %v", err)
 	}
 	defer r.Body.Close()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Fatalf("failed to read response body, %v", err)
+		return "", fmt.Errorf("failed to read response body, %v", err)
 	}
 
 	ip := struct {
@@ -123,72 +126,118 @@ func getIP() string {
 	}{}
 	err = json.Unmarshal(body, &ip)
 	if err != nil {
-		log.Fatalf("failed to unmarshal IP address, %v", err)
+		return "", fmt.Errorf("failed to unmarshal IP address, %v", err)
 	}
 
-	return ip.Query
+	return ip.Query, nil
 }
 
-// createInstance creates count amount of EC2 instances and attempts to tag them
-func createBastion(client *ec2.Client, k3scfg *cfg, vpcID, idAMI string) (id, ip string) {
-	// print creating
-	log.Printf("Creating bastion node %q for cluster %q.\n", k3scfg.clusterName+"-bastion", k3scfg.clusterName)
-
-	// validate subnet-ids
-	idsBastion := getPublicSubnets(client, k3scfg, vpcID)
+// createBastion creates the bastion and its SG, reusing either if it exists from an earlier deploy
+func createBastion(client *ec2.Client, k3scfg *cfg, vpcID, idAMI string, existing *existingCluster) (id, ip string, err error) {
+	name := k3scfg.clusterName + "-bastion"
 
 	// create SGs for bastion
-	idSG := createSG(client, k3scfg.clusterName, k3scfg.clusterName+"-bastion", vpcID)
+	idSG, ok := existing.securityGroup(name + "-sg")
+	if ok {
+		log.Printf("Reusing Security Group with ID: %q\n", idSG)
+	} else {
+		idSG, err = createSG(client, k3scfg, name, vpcID)
+		if err != nil {
+			return "", "", err
+		}
+	}
 
 	// get local public IP for SSH in bastion SG rule
-	pubIP := getIP()
+	pubIP, err := getIP()
+	if err != nil {
+		return "", "", err
+	}
 
 	// create SG rules for bastion
-	createBastionSGRules(client, idSG, pubIP)
-
-	// inputs
-	// use one for min and max since we want to create one instance at a time in each subnet
-	one := int32(1)
-
-	runInput := &ec2.RunInstancesInput{
-		ImageId:          &idAMI,
-		InstanceType:     types.InstanceTypeT2Micro,
-		KeyName:          &k3scfg.key,
-		MinCount:         &one,
-		MaxCount:         &one,
-		SecurityGroupIds: []string{idSG},
-		SubnetId:         &idsBastion[0],
+	if err := createBastionSGRules(client, idSG, pubIP); err != nil {
+		return "", "", err
 	}
 
-	// Build the request with its input parameters
-	result, err := client.RunInstances(context.TODO(), runInput)
-	if err != nil {
-		log.Fatalf("failed to create instance, %v", err)
+	id, reused := existing.instance(name)
+	if reused {
+		log.Printf("Reusing bastion instance with ID: %q\n", id)
+	} else if id, err = runBastion(client, k3scfg, vpcID, idAMI, idSG); err != nil {
+		return "", "", err
 	}
 
-	// tag the instance after creation
-	tagInstance(client, result.Instances, k3scfg.clusterName, k3scfg.clusterName+"-bastion")
-
 	// loop waiting for instance state
-	var ipBastion []string
 	numChecks := 45
 
 	log.Println("Waiting on instance to attach public ip.")
 	for i := 1; i <= numChecks; i++ {
-		_, _, _, ipBastion = describeInstance(client, k3scfg, "-bastion", *result.Instances[0].InstanceId)
-		if ipBastion[0] != "" {
+		instances, err := describeInstancesByID(client, []string{id})
+		if err != nil {
+			return "", "", err
+		}
+		if v, ok := instances[id]; ok && v.PublicIpAddress != nil {
+			ip = *v.PublicIpAddress
 			break
 		}
-		time.Sleep(time.Second * 2)
+		if err := sleep(time.Second * 2); err != nil {
+			return "", "", err
+		}
+	}
+	if ip == "" {
+		return "", "", fmt.Errorf("failed to get a public ip for instance with id %q", id)
 	}
-	if ipBastion[0] == "" {
-		log.Fatalf("failed to get instance state of 'ready' for instance with id %q\n", *result.Instances[0].InstanceId)
+
+	log.Printf("Bastion instance with ID: %q - PublicIP: %q\n", id, ip)
+
+	// pin the bastion host keys so the first ssh hop is verified, a reused bastion is
+	// usually pinned already
+	if reused {
+		err = ensureHostKeys(client, k3scfg, id, ip)
+	} else {
+		err = waitHostKeys(client, k3scfg, id, ip)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return id, ip, nil
+}
+
+// runBastion launches the bastion instance in a public subnet of the VPC
+func runBastion(client *ec2.Client, k3scfg *cfg, vpcID, idAMI, idSG string) (string, error) {
+	name := k3scfg.clusterName + "-bastion"
+
+	// print creating
+	log.Printf("Creating bastion node %q for cluster %q.\n", name, k3scfg.clusterName)
+
+	// validate subnet-ids
+	idsBastion, err := getPublicSubnets(client, k3scfg, vpcID)
+	if err != nil {
+		return "", err
+	}
+
+	// inputs
+	// use one for min and max since we want to create one instance at a time in each subnet
+	one := int32(1)
+
+	runInput := &ec2.RunInstancesInput{
+		ImageId:             &idAMI,
+		InstanceType:        types.InstanceType(k3scfg.bastionType),
+		KeyName:             &k3scfg.key,
+		MinCount:            &one,
+		MaxCount:            &one,
+		SecurityGroupIds:    []string{idSG},
+		SubnetId:            &idsBastion[0],
+		BlockDeviceMappings: rootVolumeMappings(k3scfg, "bastion", k3scfg.arch),
+		TagSpecifications:   launchTagSpecs(k3scfg, name, idAMI),
 	}
 
-	for _, v := range result.Instances {
-		id = *v.InstanceId
-		log.Printf("Created bastion instance with ID: %q - PublicIP: %q\n", id, ipBastion[0])
+	// Build the request with its input parameters
+	result, err := client.RunInstances(context.TODO(), runInput)
+	if err != nil {
+		return "", fmt.Errorf("failed to create instance, %v", err)
 	}
 
-	return id, ipBastion[0]
+	k3scfg.state.addInstance(result.Instances[0], name, "bastion")
+
+	return *result.Instances[0].InstanceId, nil
 }
@@ -2,28 +2,84 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
-	"log"
 )
 
+// awsOptions selects the region, shared config profile and optional role to authenticate with
+type awsOptions struct {
+	region     string
+	profile    string
+	roleARN    string
+	externalID string
+	mfaSerial  string
+}
+
+// defineAWSFlags adds the AWS authentication flags to fs. The region flag is skipped when
+// the command already sets the region from elsewhere, e.g. the create spec.
+func defineAWSFlags(fs *flag.FlagSet, withRegion bool) *awsOptions {
+	o := &awsOptions{}
+	if withRegion {
+		fs.StringVar(&o.region, "region", os.Getenv("K3S_REGION"), "The AWS region. (ENV K3S_REGION)")
+	}
+	fs.StringVar(&o.profile, "profile", "", "The AWS shared config profile to use. (ENV AWS_PROFILE)")
+	fs.StringVar(&o.roleARN, "role-arn", os.Getenv("K3S_ROLE_ARN"), "The ARN of an IAM role to assume. (ENV K3S_ROLE_ARN)")
+	fs.StringVar(&o.externalID, "external-id", os.Getenv("K3S_EXTERNAL_ID"), "The external ID used when assuming the role. (ENV K3S_EXTERNAL_ID)")
+	fs.StringVar(&o.mfaSerial, "mfa-serial", os.Getenv("K3S_MFA_SERIAL"), "The MFA device serial or ARN, the token code is read from stdin. (ENV K3S_MFA_SERIAL)")
+	return o
+}
+
 // initAWS uses Default Config with specified region to authenticate
 // using the SDK's default configuration, loading additional config
 // and credentials values from the environment variables, shared
-// credentials, and shared configuration files
-func initAWS() aws.Config {
-	//TODO input var for region pass in as config.LoadDefaultConfig(context.TODO(),config.WithRegion(region))
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+// credentials, and shared configuration files. If a role ARN is set
+// the loaded credentials are used to assume that role.
+func initAWS(o *awsOptions) aws.Config {
+	var opts []func(*config.LoadOptions) error
+	if o.region != "" {
+		opts = append(opts, config.WithRegion(o.region))
+	}
+	if o.profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(o.profile))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
+	if cfg.Region == "" {
+		log.Fatalf("no AWS region set, use the region flag, the spec region field or the AWS_REGION ENV variable.")
+	}
+
+	if o.roleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), o.roleARN, func(ao *stscreds.AssumeRoleOptions) {
+			ao.RoleSessionName = "k3sdeploy-" + strconv.FormatInt(time.Now().Unix(), 10)
+			if o.externalID != "" {
+				ao.ExternalID = aws.String(o.externalID)
+			}
+			if o.mfaSerial != "" {
+				ao.SerialNumber = aws.String(o.mfaSerial)
+				ao.TokenProvider = stscreds.StdinTokenProvider
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
 	return cfg
 }
 
-// getCallerId prints the ARN and userID of the request maker from cfg
-func getCallerId(cfg aws.Config) {
+// getCallerId prints the account, ARN and userID of the request maker from cfg to w
+func getCallerId(cfg aws.Config, w io.Writer) {
 
 	client := sts.NewFromConfig(cfg)
 
@@ -32,5 +88,5 @@ func getCallerId(cfg aws.Config) {
 		log.Fatalf("failed to get identity, %v", err)
 	}
 
-	fmt.Println(*result.Arn + " - " + *result.UserId)
+	fmt.Fprintf(w, "Using AWS account %s in region %s as %s - %s\n", *result.Account, cfg.Region, *result.Arn, *result.UserId)
 }
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// external datastore engines, an empty datastore keeps the k3s state on the servers
+const (
+	datastorePostgres = "postgres"
+	datastoreMySQL    = "mysql"
+)
+
+// datastore instance settings, the smallest that k3s runs well on
+const (
+	datastoreClass   = "db.t3.micro"
+	datastoreStorage = 20
+	datastoreDBName  = "k3s"
+	datastoreUser    = "k3s"
+)
+
+// how long create waits on the datastore to be available and delete waits on it to be gone
+const datastoreTimeout = 30 * time.Minute
+
+// datastorePorts is the port of each datastore engine
+var datastorePorts = map[string]int32{
+	datastorePostgres: 5432,
+	datastoreMySQL:    3306,
+}
+
+// datastoreVersions is the major version of each datastore engine, RDS picks its default minor
+// version. Both enforce TLS by default, as does datastoreEndpoint.
+var datastoreVersions = map[string]string{
+	datastorePostgres: "16",
+	datastoreMySQL:    "8.0",
+}
+
+// datastoreName returns the identifier of the cluster datastore, also used for its subnet group
+func datastoreName(clusterName string) string {
+	return strings.ToLower(clusterName) + "-datastore"
+}
+
+// rdsTags converts the k3sdeploy tags of a resource called name to RDS tags
+func rdsTags(k3scfg *cfg, name string) (tags []rdstypes.Tag) {
+	for _, v := range clusterTags(k3scfg, name) {
+		tags = append(tags, rdstypes.Tag{Key: v.Key, Value: v.Value})
+	}
+	return tags
+}
+
+// rdsTagValue returns the value of the RDS tag with key or an empty string
+func rdsTagValue(tags []rdstypes.Tag, key string) string {
+	for _, v := range tags {
+		if v.Key != nil && *v.Key == key && v.Value != nil {
+			return *v.Value
+		}
+	}
+	return ""
+}
+
+// datastoreEndpointPath is the root only file on the servers holding the datastore endpoint
+const datastoreEndpointPath = "/etc/rancher/k3s/datastore-endpoint"
+
+// datastoreEndpoint returns the k3s --datastore-endpoint of the datastore at host, connecting
+// over TLS without verifying the RDS certificate, which isn't signed by a CA of the servers
+func datastoreEndpoint(engine, password, host string) string {
+	port := datastorePorts[engine]
+	if engine == datastoreMySQL {
+		return fmt.Sprintf("mysql://%s:%s@tcp(%s:%d)/%s?tls=skip-verify", datastoreUser, password, host, port, datastoreDBName)
+	}
+	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=require", datastoreUser, password, host, port, datastoreDBName)
+}
+
+// loadDatastorePassword reads the datastore password saved by an earlier deploy, generating
+// and saving a new one if there is none
+func loadDatastorePassword(k3scfg *cfg) (string, error) {
+	dir, err := clusterDir(k3scfg.clusterName)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "datastore-password")
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read datastore password %q, %v", path, err)
+	}
+
+	// a hex cluster token fits the password rules of both engines
+	password, err := newClusterToken()
+	if err != nil {
+		return "", err
+	}
+	password = password[:32]
+	if err := ioutil.WriteFile(path, []byte(password+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write datastore password to %q, %v", path, err)
+	}
+	return password, nil
+}
+
+// createDatastoreSGRules opens the datastore port of the datastore SG with id to the cluster SG
+func createDatastoreSGRules(client *ec2.Client, k3scfg *cfg, id, idClusterSG string) error {
+	proto := "TCP"
+	port := datastorePorts[k3scfg.datastore]
+
+	sgIngressInput := &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: &id,
+		IpPermissions: []types.IpPermission{
+			{
+				FromPort:   &port,
+				IpProtocol: &proto,
+				ToPort:     &port,
+				UserIdGroupPairs: []types.UserIdGroupPair{
+					{
+						GroupId: &idClusterSG,
+					},
+				},
+			},
+		},
+	}
+
+	// rules already exist when resuming a deploy
+	_, err := client.AuthorizeSecurityGroupIngress(context.TODO(), sgIngressInput)
+	if err != nil && !isAPIError(err, "InvalidPermission.Duplicate") {
+		return fmt.Errorf("failed to create datastore ingress security group rule, %v", err)
+	}
+	return nil
+}
+
+// createDatastore creates the RDS instance holding the k3s state in the spec subnets, only
+// reachable from the cluster SG, and waits for it to be available. A datastore left by an
+// earlier deploy of the cluster is reused. The k3s --datastore-endpoint is returned.
+func createDatastore(awscfg aws.Config, k3scfg *cfg, vpcID, idClusterSG string, existing *existingCluster) (string, error) {
+	client := ec2.NewFromConfig(awscfg)
+	dbClient := rds.NewFromConfig(awscfg)
+	name := datastoreName(k3scfg.clusterName)
+
+	// RDS wants subnets in at least two availability zones
+	subnets, err := subnetsPerAZ(client, k3scfg.subnets)
+	if err != nil {
+		return "", err
+	}
+	if len(subnets) < 2 {
+		return "", fmt.Errorf("the %s datastore needs subnets in at least two availability zones, %q are in one", k3scfg.datastore, strings.Join(k3scfg.subnets, ","))
+	}
+
+	password, err := loadDatastorePassword(k3scfg)
+	if err != nil {
+		return "", err
+	}
+
+	idSG, ok := existing.securityGroup(k3scfg.clusterName + "-datastore-sg")
+	if ok {
+		log.Printf("Reusing Security Group with ID: %q\n", idSG)
+	} else if idSG, err = createSG(client, k3scfg, k3scfg.clusterName+"-datastore", vpcID); err != nil {
+		return "", err
+	}
+	if err := createDatastoreSGRules(client, k3scfg, idSG, idClusterSG); err != nil {
+		return "", err
+	}
+
+	description := "k3s datastore of " + k3scfg.clusterName
+	_, err = dbClient.CreateDBSubnetGroup(context.TODO(), &rds.CreateDBSubnetGroupInput{
+		DBSubnetGroupName:        &name,
+		DBSubnetGroupDescription: &description,
+		SubnetIds:                k3scfg.subnets,
+		Tags:                     rdsTags(k3scfg, name),
+	})
+	if err != nil && !isAPIError(err, "DBSubnetGroupAlreadyExists") {
+		return "", fmt.Errorf("failed to create datastore subnet group %q, %v", name, err)
+	}
+	k3scfg.state.update(func(s *clusterState) {
+		s.Datastore = &stateDatastore{Engine: k3scfg.datastore, SubnetGroup: name}
+	})
+
+	// the instance of a resumed deploy is reused, CreateDBInstance is not idempotent
+	_, err = dbClient.DescribeDBInstances(context.TODO(), &rds.DescribeDBInstancesInput{DBInstanceIdentifier: &name})
+	switch {
+	case err == nil:
+		log.Printf("Reusing datastore %q.\n", name)
+	case isAPIError(err, "DBInstanceNotFound"):
+		engine := k3scfg.datastore
+		version := datastoreVersions[engine]
+		class := datastoreClass
+		storage := int32(datastoreStorage)
+		dbName := datastoreDBName
+		user := datastoreUser
+		port := datastorePorts[engine]
+		_, err = dbClient.CreateDBInstance(context.TODO(), &rds.CreateDBInstanceInput{
+			DBInstanceIdentifier: &name,
+			DBInstanceClass:      &class,
+			Engine:               &engine,
+			EngineVersion:        &version,
+			AllocatedStorage:     &storage,
+			DBName:               &dbName,
+			MasterUsername:       &user,
+			MasterUserPassword:   &password,
+			Port:                 &port,
+			DBSubnetGroupName:    &name,
+			VpcSecurityGroupIds:  []string{idSG},
+			PubliclyAccessible:   aws.Bool(false),
+			StorageEncrypted:     aws.Bool(true),
+			CopyTagsToSnapshot:   aws.Bool(true),
+			Tags:                 rdsTags(k3scfg, name),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create datastore %q, %v", name, err)
+		}
+		log.Printf("Created %s %s datastore %q.\n", engine, version, name)
+	default:
+		return "", fmt.Errorf("failed to describe datastore %q, %v", name, err)
+	}
+	k3scfg.state.update(func(s *clusterState) {
+		s.Datastore.Identifier = name
+	})
+	if err := checkInterrupted(); err != nil {
+		return "", err
+	}
+
+	log.Printf("Waiting up to %s on datastore %q to be available.\n", datastoreTimeout, name)
+	waiter := rds.NewDBInstanceAvailableWaiter(dbClient, func(o *rds.DBInstanceAvailableWaiterOptions) {
+		o.MinDelay = 15 * time.Second
+		o.MaxDelay = 60 * time.Second
+	})
+	err = waiter.Wait(context.TODO(), &rds.DescribeDBInstancesInput{DBInstanceIdentifier: &name}, datastoreTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to wait on datastore %q to be available, %v", name, err)
+	}
+
+	result, err := dbClient.DescribeDBInstances(context.TODO(), &rds.DescribeDBInstancesInput{DBInstanceIdentifier: &name})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe datastore %q, %v", name, err)
+	}
+	endpoint := result.DBInstances[0].Endpoint
+	if endpoint == nil || endpoint.Address == nil {
+		return "", fmt.Errorf("datastore %q has no endpoint", name)
+	}
+	k3scfg.state.update(func(s *clusterState) {
+		s.Datastore.Endpoint = *endpoint.Address
+	})
+	log.Printf("Datastore %q is available at %q.\n", name, *endpoint.Address)
+
+	return datastoreEndpoint(k3scfg.datastore, password, *endpoint.Address), nil
+}
+
+// findDatastores returns the RDS instances and subnet groups tagged with the cluster name
+func findDatastores(dbClient *rds.Client, k3scfg *cfg) (instances []rdstypes.DBInstance, subnetGroups []string, err error) {
+	paginator := rds.NewDescribeDBInstancesPaginator(dbClient, &rds.DescribeDBInstancesInput{})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to describe datastores, %v", err)
+		}
+		for _, v := range result.DBInstances {
+			if rdsTagValue(v.TagList, tagK3sdeploycluster) == k3scfg.clusterName && rdsTagValue(v.TagList, tagK3sdeploy) == tagTrueValue {
+				instances = append(instances, v)
+			}
+		}
+	}
+
+	// subnet groups carry no tags when described so look up the one k3sdeploy names
+	name := datastoreName(k3scfg.clusterName)
+	result, err := dbClient.DescribeDBSubnetGroups(context.TODO(), &rds.DescribeDBSubnetGroupsInput{DBSubnetGroupName: &name})
+	if isAPIError(err, "DBSubnetGroupNotFoundFault") {
+		return instances, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to describe datastore subnet group %q, %v", name, err)
+	}
+	for _, v := range result.DBSubnetGroups {
+		tags, err := dbClient.ListTagsForResource(context.TODO(), &rds.ListTagsForResourceInput{ResourceName: v.DBSubnetGroupArn})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list tags of datastore subnet group %q, %v", name, err)
+		}
+		if rdsTagValue(tags.TagList, tagK3sdeploycluster) == k3scfg.clusterName && rdsTagValue(tags.TagList, tagK3sdeploy) == tagTrueValue {
+			subnetGroups = append(subnetGroups, *v.DBSubnetGroupName)
+		}
+	}
+
+	return instances, subnetGroups, nil
+}
+
+// deleteDatastores starts deleting the RDS instances with ids, taking a final snapshot of each
+// when snapshot is set. Deletes run in the background, waitDatastoresDeleted waits on them.
+func deleteDatastores(dbClient *rds.Client, ids []string, snapshot bool) error {
+	for _, id := range ids {
+		id := id
+		deleteInput := &rds.DeleteDBInstanceInput{
+			DBInstanceIdentifier: &id,
+			SkipFinalSnapshot:    !snapshot,
+		}
+		if snapshot {
+			snapshotID := id + "-final-" + time.Now().UTC().Format("20060102150405")
+			deleteInput.FinalDBSnapshotIdentifier = &snapshotID
+			log.Printf("Taking final snapshot %q of datastore %q.\n", snapshotID, id)
+		}
+
+		_, err := dbClient.DeleteDBInstance(context.TODO(), deleteInput)
+		if err != nil && !isAPIError(err, "DBInstanceNotFound") {
+			return fmt.Errorf("failed to delete datastore %q, %v", id, err)
+		}
+		log.Printf("Deleting datastore %q.\n", id)
+	}
+	return nil
+}
+
+// waitDatastoresDeleted waits until every RDS instance with ids is gone and then deletes the
+// subnet groups, which can only be deleted once no instance uses them
+func waitDatastoresDeleted(dbClient *rds.Client, ids, subnetGroups []string) error {
+	for _, id := range ids {
+		id := id
+		log.Printf("Waiting up to %s on datastore %q to be deleted.\n", datastoreTimeout, id)
+		waiter := rds.NewDBInstanceDeletedWaiter(dbClient, func(o *rds.DBInstanceDeletedWaiterOptions) {
+			o.MinDelay = 15 * time.Second
+			o.MaxDelay = 60 * time.Second
+		})
+		err := waiter.Wait(context.TODO(), &rds.DescribeDBInstancesInput{DBInstanceIdentifier: &id}, datastoreTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to wait on datastore %q to be deleted, %v", id, err)
+		}
+	}
+
+	for _, name := range subnetGroups {
+		name := name
+		_, err := dbClient.DeleteDBSubnetGroup(context.TODO(), &rds.DeleteDBSubnetGroupInput{DBSubnetGroupName: &name})
+		if err != nil && !isAPIError(err, "DBSubnetGroupNotFoundFault") {
+			return fmt.Errorf("failed to delete datastore subnet group %q, %v", name, err)
+		}
+		log.Printf("Deleted datastore subnet group %q.\n", name)
+	}
+	return nil
+}
+
+// pushDatastoreEndpoint writes the datastore endpoint to a root only file on every server via
+// the bastion. The endpoint holds the database password, so it is pushed over ssh instead of
+// put in the user data, which anyone allowed ec2:DescribeInstanceAttribute can read.
+func pushDatastoreEndpoint(client *ec2.Client, k3scfg *cfg, ipBastion string) error {
+	live, err := describeInstancesByID(client, k3scfg.state.instanceIDs())
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(datastoreEndpointPath)
+	cmd := fmt.Sprintf("sudo sh -c 'mkdir -p %s && umask 077 && cat > %s.tmp && mv %s.tmp %s'", dir, datastoreEndpointPath, datastoreEndpointPath, datastoreEndpointPath)
+	for _, v := range k3scfg.state.Instances {
+		inst, ok := live[v.ID]
+		// 0 - pending, 16 - running
+		if (v.Role != "main" && v.Role != "server") || !ok || (*inst.State.Code != 0 && *inst.State.Code != 16) {
+			continue
+		}
+		ip := aws.ToString(inst.PrivateIpAddress)
+
+		if err := ensureHostKeys(client, k3scfg, v.ID, ip); err != nil {
+			return err
+		}
+		if err := checkInterrupted(); err != nil {
+			return err
+		}
+		if _, err := sshRunInput(k3scfg.sshConfig, ipBastion, ip, cmd, []byte(k3scfg.datastoreEndpoint), 40, 15*time.Second); err != nil {
+			return fmt.Errorf("failed to write datastore endpoint to server %q via bastion %q, %v", ip, ipBastion, err)
+		}
+		log.Printf("Wrote datastore endpoint to %s %q.\n", v.Role, v.Name)
+	}
+	return nil
+}
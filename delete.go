@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -18,24 +24,52 @@ const (
 	resetText = "\033[0m"
 )
 
-// terminateInstance destroys the instance with id
-func terminateInstance(client *ec2.Client, id string) {
+// how long deletes wait on instances to terminate and on security groups to be released
+const (
+	terminateTimeout = 10 * time.Minute
+	deleteSGTimeout  = 5 * time.Minute
+)
+
+// terminateInstances destroys every instance in ids with a single call
+func terminateInstances(client *ec2.Client, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
 
 	// inputs
 	terminateInput := &ec2.TerminateInstancesInput{
-		InstanceIds: []string{id},
+		InstanceIds: ids,
 	}
 
 	_, err := client.TerminateInstances(context.TODO(), terminateInput)
 	if err != nil {
-		log.Fatalf("failed to terminate instance, %v", err)
+		return fmt.Errorf("failed to terminate instances %q, %v", strings.Join(ids, ","), err)
 	}
 
-	log.Printf("Terminated instance with ID: %q\n", id)
+	log.Printf("Terminating instances %q.\n", strings.Join(ids, ","))
+	return nil
+}
+
+// waitTerminated waits with a single waiter until every instance in ids is terminated
+func waitTerminated(client *ec2.Client, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	log.Printf("Waiting on %d instances to reach state 'terminated'.\n", len(ids))
+	waiter := ec2.NewInstanceTerminatedWaiter(client, func(o *ec2.InstanceTerminatedWaiterOptions) {
+		o.MinDelay = 5 * time.Second
+		o.MaxDelay = 30 * time.Second
+	})
+	err := waiter.Wait(context.TODO(), &ec2.DescribeInstancesInput{InstanceIds: ids}, terminateTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to wait on instances %q to terminate, %v", strings.Join(ids, ","), err)
+	}
+	return nil
 }
 
 // describeSG returns sg ids created by this tool and associated with the cluster name
-func describeSG(client *ec2.Client, k3scfg *cfg) (ids []string) {
+func describeSG(client *ec2.Client, k3scfg *cfg) (ids []string, err error) {
 
 	// inputs
 	var tagK3sdeploycluster = "tag:" + tagK3sdeploycluster
@@ -56,7 +90,7 @@ func describeSG(client *ec2.Client, k3scfg *cfg) (ids []string) {
 
 	result, err := client.DescribeSecurityGroups(context.TODO(), describeInput)
 	if err != nil {
-		log.Fatalf("failed to describe security group, %v", err)
+		return nil, fmt.Errorf("failed to describe security group, %v", err)
 	}
 
 	// loop over results to get matching instance id
@@ -64,104 +98,455 @@ func describeSG(client *ec2.Client, k3scfg *cfg) (ids []string) {
 		ids = append(ids, *v.GroupId)
 	}
 
-	return ids
+	return ids, nil
 }
 
-// deleteSG destroys the sg with id
-func deleteSG(client *ec2.Client, id string) {
+// deleteSG destroys the sg with id. The network interfaces of terminated instances take a
+// while to detach so DependencyViolation is retried with backoff until deleteSGTimeout.
+func deleteSG(client *ec2.Client, id string) error {
 
 	// inputs
 	sgInput := &ec2.DeleteSecurityGroupInput{
 		GroupId: &id,
 	}
 
-	// delete SG
-	_, err := client.DeleteSecurityGroup(context.TODO(), sgInput)
-	if err != nil {
-		log.Fatalf("failed to delete security group, %v", err)
+	delay := 2 * time.Second
+	deadline := time.Now().Add(deleteSGTimeout)
+	for {
+		// delete SG
+		_, err := client.DeleteSecurityGroup(context.TODO(), sgInput)
+		if err == nil || isAPIError(err, "InvalidGroup.NotFound") {
+			break
+		}
+		if !isAPIError(err, "DependencyViolation") || time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("failed to delete security group %q, %v", id, err)
+		}
+
+		log.Printf("Security group %q is still in use, retrying in %s.\n", id, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
 	}
 
 	log.Printf("Deleted security group with ID: %q\n", id)
+	return nil
 }
 
-// terminateSequence uses cluster name and k3sdeploy=true tags to identify which instances/sgs are
-// associated to the cluster and destroys them one at a time.
-func terminateSequence(awscfg aws.Config, k3scfg *cfg) {
-	usrInput := "NO"
-	fmt.Printf("\n%s%s%s\n", boldText, strings.Repeat("#", 150), resetText)
-	fmt.Printf("\nThe '-d' flag was found. This %sDESTROYS THE CLUSTER and BASTION%s.\n", redText, resetText)
-	fmt.Printf("Are you sure you want to continue with the %sDESTROY%s?. Only %s'YES'%s will be accepted.\n%s%sCONTINUE DESTROY?%s:", redText, resetText, boldText, resetText, boldText, redText, resetText)
-	fmt.Scanln(&usrInput)
-	if usrInput == "YES" {
-		//continue
-	} else {
-		fmt.Println("Cancelling.")
-		os.Exit(1)
+// deleteSGs destroys the sgs with ids in dependency order, the datastore SG named by names
+// first since its rule references the cluster SG and the bastion SG last, returning the ids
+// that could not be deleted
+func deleteSGs(client *ec2.Client, ids []string, names map[string]string) (failed []string) {
+	ordered := make([]string, 0, len(ids))
+	var bastion []string
+	for _, id := range ids {
+		if strings.HasSuffix(names[id], "-datastore-sg") {
+			ordered = append(ordered, id)
+		}
 	}
+	for _, id := range ids {
+		switch {
+		case strings.HasSuffix(names[id], "-datastore-sg"):
+		case strings.HasSuffix(names[id], "-bastion-sg"):
+			bastion = append(bastion, id)
+		default:
+			ordered = append(ordered, id)
+		}
+	}
+	ordered = append(ordered, bastion...)
 
-	// Using the Config value, create the s3 client
-	client := ec2.NewFromConfig(awscfg)
+	for _, id := range ordered {
+		if err := deleteSG(client, id); err != nil {
+			log.Printf("%v", err)
+			failed = append(failed, id)
+		}
+	}
+	return failed
+}
+
+// deleteOptions controls how terminateSequence confirms and reports a delete
+type deleteOptions struct {
+	// yes skips both confirmations, dryRun only reports the plan
+	yes    bool
+	dryRun bool
+	output string
+	// snapshot takes a final snapshot of the datastore before deleting it
+	snapshot bool
+}
+
+// output formats of the delete plan
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
 
-	// lookup instances
-	idsIn, _, _, _ := describeInstance(client, k3scfg, "", "")
+// planInstance is an instance the delete will terminate
+type planInstance struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
 
-	// lookup sgs
-	idsSG := describeSG(client, k3scfg)
+// planSecurityGroup is a security group the delete will remove
+type planSecurityGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
 
-	// exit early if nothing found
-	if len(idsIn) == 0 && len(idsSG) == 0 {
-		fmt.Printf("\nNo resources found associated with the %q cluster. Exiting.\n", k3scfg.clusterName)
-		os.Exit(0)
+// planLoadBalancer is a load balancer the delete will remove
+type planLoadBalancer struct {
+	ARN     string `json:"arn"`
+	Name    string `json:"name"`
+	DNSName string `json:"dnsName"`
+}
+
+// planTargetGroup is a target group the delete will remove
+type planTargetGroup struct {
+	ARN  string `json:"arn"`
+	Name string `json:"name"`
+}
+
+// planDatastore is an RDS datastore the delete will remove
+type planDatastore struct {
+	Identifier string `json:"identifier"`
+	Engine     string `json:"engine"`
+	Status     string `json:"status"`
+}
+
+// deletePlan is every resource a delete of the cluster removes along with where the state
+// file and tag discovery disagree
+type deletePlan struct {
+	Cluster        string              `json:"cluster"`
+	Region         string              `json:"region"`
+	DryRun         bool                `json:"dryRun"`
+	StateFile      bool                `json:"stateFile"`
+	Instances      []planInstance      `json:"instances"`
+	SecurityGroups []planSecurityGroup `json:"securityGroups"`
+	LoadBalancers  []planLoadBalancer  `json:"loadBalancers"`
+	TargetGroups   []planTargetGroup   `json:"targetGroups"`
+	Datastores     []planDatastore     `json:"datastores"`
+	SubnetGroups   []string            `json:"datastoreSubnetGroups"`
+	Snapshot       bool                `json:"snapshot"`
+	Untagged       []string            `json:"untagged,omitempty"`
+	Unrecorded     []string            `json:"unrecorded,omitempty"`
+	Gone           []string            `json:"gone,omitempty"`
+}
+
+// newDeletePlan describes the resources found by r so the plan shows names and states,
+// along with the load balancers lbs, target groups tgs, datastores dbs and their subnet groups
+// found by tags
+func newDeletePlan(client *ec2.Client, k3scfg *cfg, region string, state *clusterState, r *reconciliation, lbs []elbtypes.LoadBalancer, tgs []elbtypes.TargetGroup, dbs []rdstypes.DBInstance, subnetGroups []string) (*deletePlan, error) {
+	plan := &deletePlan{
+		Cluster:        k3scfg.clusterName,
+		Region:         region,
+		StateFile:      state != nil,
+		Instances:      []planInstance{},
+		SecurityGroups: []planSecurityGroup{},
+		LoadBalancers:  []planLoadBalancer{},
+		TargetGroups:   []planTargetGroup{},
+		Datastores:     []planDatastore{},
+		SubnetGroups:   append([]string{}, subnetGroups...),
+		Untagged:       r.untagged,
+		Unrecorded:     r.unrecorded,
+		Gone:           r.gone,
+	}
+
+	instances, err := describeInstancesByID(client, r.instances)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range r.instances {
+		v := instances[id]
+		inst := planInstance{ID: id, Name: tagValue(v.Tags, tagName)}
+		if v.State != nil {
+			inst.State = instanceStates[*v.State.Code]
+		}
+		plan.Instances = append(plan.Instances, inst)
+	}
+
+	groups, err := describeSGsByID(client, r.securityGroups)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range r.securityGroups {
+		plan.SecurityGroups = append(plan.SecurityGroups, planSecurityGroup{ID: id, Name: aws.ToString(groups[id].GroupName)})
 	}
 
-	fmt.Printf("\n%s%s%s\nThe following resources were found to belong to the %s%q%s cluster.\n", boldText, strings.Repeat("#", 20), resetText, boldText, k3scfg.clusterName, resetText)
-	fmt.Printf("\nThe instances that will be %sDESTROYED%s are:\n", redText, resetText)
+	for _, v := range lbs {
+		plan.LoadBalancers = append(plan.LoadBalancers, planLoadBalancer{ARN: *v.LoadBalancerArn, Name: aws.ToString(v.LoadBalancerName), DNSName: aws.ToString(v.DNSName)})
+	}
+	for _, v := range tgs {
+		plan.TargetGroups = append(plan.TargetGroups, planTargetGroup{ARN: *v.TargetGroupArn, Name: aws.ToString(v.TargetGroupName)})
+	}
+	for _, v := range dbs {
+		plan.Datastores = append(plan.Datastores, planDatastore{Identifier: *v.DBInstanceIdentifier, Engine: aws.ToString(v.Engine), Status: aws.ToString(v.DBInstanceStatus)})
+	}
+
+	return plan, nil
+}
+
+// printPlanText prints the resources of the plan
+func printPlanText(plan *deletePlan) {
+	verb := "will be"
+	if plan.DryRun {
+		verb = "would be"
+	}
+
+	fmt.Printf("\n%s%s%s\nThe following resources were found to belong to the %s%q%s cluster.\n", boldText, strings.Repeat("#", 20), resetText, boldText, plan.Cluster, resetText)
+	fmt.Printf("\nThe instances that %s %sDESTROYED%s are:\n", verb, redText, resetText)
+	for _, v := range plan.Instances {
+		fmt.Printf("   %s  %s  %s\n", v.ID, valueOr(v.Name, "-"), v.State)
+	}
+
+	fmt.Printf("\nAssociated security groups that %s also %sDESTROYED%s are:\n", verb, redText, resetText)
+	for _, v := range plan.SecurityGroups {
+		fmt.Printf("   %s  %s\n", v.ID, valueOr(v.Name, "-"))
+	}
 
-	for _, v := range idsIn {
-		fmt.Println("  ", v)
+	if len(plan.LoadBalancers) > 0 || len(plan.TargetGroups) > 0 {
+		fmt.Printf("\nLoad balancers and target groups that %s also %sDESTROYED%s are:\n", verb, redText, resetText)
+		for _, v := range plan.LoadBalancers {
+			fmt.Printf("   %s  %s\n", v.Name, v.DNSName)
+		}
+		for _, v := range plan.TargetGroups {
+			fmt.Printf("   %s  (target group)\n", v.Name)
+		}
 	}
 
-	fmt.Printf("\nAssociated security groups that will also be %sDESTROYED%s are:\n", redText, resetText)
-	for _, v := range idsSG {
-		fmt.Println("  ", v)
+	if len(plan.Datastores) > 0 || len(plan.SubnetGroups) > 0 {
+		snapshot := "without"
+		if plan.Snapshot {
+			snapshot = "after"
+		}
+		fmt.Printf("\nDatastores that %s also %sDESTROYED%s %s a final snapshot are:\n", verb, redText, resetText, snapshot)
+		for _, v := range plan.Datastores {
+			fmt.Printf("   %s  %s  %s\n", v.Identifier, v.Engine, v.Status)
+		}
+		for _, v := range plan.SubnetGroups {
+			fmt.Printf("   %s  (subnet group)\n", v)
+		}
 	}
 	fmt.Printf("%s%s%s\n", boldText, strings.Repeat("#", 20), resetText)
+}
+
+// printPlanJSON prints the plan as indented JSON
+func printPlanJSON(plan *deletePlan) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(plan); err != nil {
+		return fmt.Errorf("failed to encode delete plan, %v", err)
+	}
+	return nil
+}
+
+// recordedLeft returns the load balancer, target group and datastore recorded in state that
+// still exist. Instances and security groups recorded in state are checked by reconcile.
+func recordedLeft(lbClient *elb.Client, dbClient *rds.Client, state *clusterState) (left []string, err error) {
+	if state == nil {
+		return nil, nil
+	}
+
+	if lb := state.LoadBalancer; lb != nil && lb.ARN != "" {
+		_, err := lbClient.DescribeLoadBalancers(context.TODO(), &elb.DescribeLoadBalancersInput{LoadBalancerArns: []string{lb.ARN}})
+		if err == nil {
+			left = append(left, lb.ARN)
+		} else if !isAPIError(err, "LoadBalancerNotFound") {
+			return nil, fmt.Errorf("failed to describe load balancer %q, %v", lb.ARN, err)
+		}
+	}
+	if lb := state.LoadBalancer; lb != nil && lb.TargetGroupARN != "" {
+		_, err := lbClient.DescribeTargetGroups(context.TODO(), &elb.DescribeTargetGroupsInput{TargetGroupArns: []string{lb.TargetGroupARN}})
+		if err == nil {
+			left = append(left, lb.TargetGroupARN)
+		} else if !isAPIError(err, "TargetGroupNotFound") {
+			return nil, fmt.Errorf("failed to describe target group %q, %v", lb.TargetGroupARN, err)
+		}
+	}
+	if db := state.Datastore; db != nil && db.Identifier != "" {
+		_, err := dbClient.DescribeDBInstances(context.TODO(), &rds.DescribeDBInstancesInput{DBInstanceIdentifier: &db.Identifier})
+		if err == nil {
+			left = append(left, db.Identifier)
+		} else if !isAPIError(err, "DBInstanceNotFound") {
+			return nil, fmt.Errorf("failed to describe datastore %q, %v", db.Identifier, err)
+		}
+	}
+	return left, nil
+}
+
+// terminateSequence uses the cluster state file together with the cluster name and k3sdeploy=true
+// tags to identify which instances/sgs/load balancers/datastores are associated to the cluster,
+// deletes the load balancers, terminates every instance at once while the datastores are deleted
+// and then deletes the sgs.
+// Unless opts.yes is set the destroy is confirmed twice after the plan is printed, and with
+// opts.dryRun only the plan is printed. The returned exit code is non-zero when the destroy was cancelled.
+func terminateSequence(awscfg aws.Config, k3scfg *cfg, opts deleteOptions) int {
+	interactive := !opts.yes && !opts.dryRun
+
+	// Using the Config value, create the s3 client
+	client := ec2.NewFromConfig(awscfg)
+
+	// lookup instances and sgs from the state file, falling back to tags
+	state, err := loadClusterState(k3scfg.clusterName)
+	if err != nil {
+		log.Printf("ignoring state file, %v", err)
+	}
+	// looking in another region finds nothing and would drop the state of a live cluster
+	if state != nil && state.Region != "" && state.Region != awscfg.Region {
+		log.Printf("cluster %q was deployed to region %q, not %q, run the delete with --region %s", k3scfg.clusterName, state.Region, awscfg.Region, state.Region)
+		return exitError
+	}
+	r, err := reconcile(client, k3scfg, state)
+	if err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+	idsIn := r.instances
+	idsSG := r.securityGroups
+
+	// load balancers are created with their tags so tags alone find them
+	lbClient := elb.NewFromConfig(awscfg)
+	lbs, tgs, err := findLoadBalancers(lbClient, k3scfg)
+	if err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+
+	dbClient := rds.NewFromConfig(awscfg)
+	dbs, subnetGroups, err := findDatastores(dbClient, k3scfg)
+	if err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+
+	plan, err := newDeletePlan(client, k3scfg, awscfg.Region, state, r, lbs, tgs, dbs, subnetGroups)
+	if err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+	plan.DryRun = opts.dryRun
+	plan.Snapshot = opts.snapshot
+	if opts.output == outputJSON {
+		if err := printPlanJSON(plan); err != nil {
+			log.Printf("%v", err)
+			return exitError
+		}
+	} else {
+		printReconciliation(k3scfg, state, r)
+	}
 
-	usrInput = "NO"
-	fmt.Printf("\nThere is no going back. Only %s'YES'%s will be accpeted.\n%s%sFINALIZE DESTROY?%s:", boldText, resetText, boldText, redText, resetText)
-	fmt.Scanln(&usrInput)
+	// exit early if nothing found
+	if len(idsIn) == 0 && len(idsSG) == 0 && len(lbs) == 0 && len(tgs) == 0 && len(dbs) == 0 && len(subnetGroups) == 0 {
+		if opts.output != outputJSON {
+			fmt.Printf("\nNo resources found associated with the %q cluster. Exiting.\n", k3scfg.clusterName)
+		}
+		if opts.dryRun {
+			return exitOK
+		}
+		// the state may record resources whose tags were removed
+		left, err := recordedLeft(lbClient, dbClient, state)
+		if err != nil {
+			log.Printf("%v", err)
+			return exitError
+		}
+		if len(left) > 0 {
+			log.Printf("the state file still records %q which exist but are not tagged, keeping %q", strings.Join(left, ","), filepath.Dir(state.path))
+			return exitError
+		}
+		removeClusterDir(k3scfg.clusterName)
+		return exitOK
+	}
 
-	if usrInput == "YES" {
-		log.Printf("Destroying cluster %q\n", k3scfg.clusterName)
-		if len(idsIn) != 0 || len(idsSG) != 0 {
-			// destroy instances
-			for _, v := range idsIn {
-				terminateInstance(client, v)
+	if opts.output != outputJSON {
+		printPlanText(plan)
+	}
 
-				// wait
-				numChecks := 45
-				log.Println("Waiting on instance state of 'terminated'.")
-				for i := 1; i <= numChecks; i++ {
-					_, inState, _, _ := describeInstance(client, k3scfg, "", v)
-					if inState[0] == 48 {
-						break
-					}
-					time.Sleep(time.Second * 2)
-				}
-			}
-			// destory sgs
-			for _, v := range idsSG {
-				deleteSG(client, v)
-			}
+	if opts.dryRun {
+		if opts.output != outputJSON {
+			fmt.Println("\nDry run, nothing was destroyed.")
 		}
-		if len(idsIn) == 0 {
-			fmt.Printf("\nNo instances in a running state found associated with the %q cluster. Skipping.\n", k3scfg.clusterName)
+		return exitOK
+	}
+
+	if interactive {
+		usrInput := "NO"
+		fmt.Printf("\n%s%s%s\n", boldText, strings.Repeat("#", 150), resetText)
+		fmt.Printf("\nThis %sDESTROYS THE %q CLUSTER and BASTION%s listed above.\n", redText, k3scfg.clusterName, resetText)
+		fmt.Printf("Are you sure you want to continue with the %sDESTROY%s?. Only %s'YES'%s will be accepted.\n%s%sCONTINUE DESTROY?%s:", redText, resetText, boldText, resetText, boldText, redText, resetText)
+		fmt.Scanln(&usrInput)
+		if usrInput != "YES" {
+			fmt.Println("Cancelling.")
+			return exitError
 		}
-		if len(idsSG) == 0 {
-			fmt.Printf("\nNo security grups found associated with the %q cluster. Skipping.\n", k3scfg.clusterName)
+	}
+
+	if interactive {
+		usrInput := "NO"
+		fmt.Printf("\nThere is no going back. Only %s'YES'%s will be accpeted.\n%s%sFINALIZE DESTROY?%s:", boldText, resetText, boldText, redText, resetText)
+		fmt.Scanln(&usrInput)
+
+		if usrInput != "YES" {
+			fmt.Println("Cancelling.")
+			return exitError
 		}
+	}
+
+	log.Printf("Destroying cluster %q\n", k3scfg.clusterName)
+	// the load balancers go first so nothing is routed to instances being terminated
+	var arnsLB, arnsTG []string
+	for _, v := range plan.LoadBalancers {
+		arnsLB = append(arnsLB, v.ARN)
+	}
+	for _, v := range plan.TargetGroups {
+		arnsTG = append(arnsTG, v.ARN)
+	}
+	if failed := deleteLoadBalancers(lbClient, arnsLB, arnsTG); len(failed) > 0 {
+		log.Printf("failed to delete load balancers %q, run the delete again to retry", strings.Join(failed, ","))
+		return exitError
+	}
+
+	// the datastores take minutes to delete so start them before the instances
+	var idsDB []string
+	for _, v := range plan.Datastores {
+		idsDB = append(idsDB, v.Identifier)
+	}
+	if err := deleteDatastores(dbClient, idsDB, opts.snapshot); err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
 
+	// destroy instances, the sgs can only be deleted once they are gone
+	if err := terminateInstances(client, idsIn); err != nil {
+		log.Printf("%v", err)
+		return exitError
 	}
+	if err := waitTerminated(client, idsIn); err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+	// the datastore SG can only be deleted once its datastore is gone
+	if err := waitDatastoresDeleted(dbClient, idsDB, subnetGroups); err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+
+	// destory sgs
+	names := map[string]string{}
+	for _, v := range plan.SecurityGroups {
+		names[v.ID] = v.Name
+	}
+	if failed := deleteSGs(client, idsSG, names); len(failed) > 0 {
+		log.Printf("failed to delete security groups %q, run the delete again to retry", strings.Join(failed, ","))
+		return exitError
+	}
+	if len(idsIn) == 0 {
+		log.Printf("No instances in a running state found associated with the %q cluster. Skipping.\n", k3scfg.clusterName)
+	}
+	if len(idsSG) == 0 {
+		log.Printf("No security grups found associated with the %q cluster. Skipping.\n", k3scfg.clusterName)
+	}
+
+	// everything is gone so drop the local state, token and known_hosts
+	removeClusterDir(k3scfg.clusterName)
 
-	os.Exit(0)
+	return exitOK
 }
@@ -2,84 +2,39 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"strconv"
+	"net"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
 )
 
 var (
-	k3sInstall = `
-#!/usr/bin/env bash
-curl -sfL https://get.k3s.io`
-
 	tagName             = "Name"
 	tagK3sdeploycluster = "k3sdeploycluster"
 	tagSource           = "source"
 	tagSourceValue      = "https://github.com/zherner/k3sdeploy"
 	tagK3sdeploy        = "k3sdeploy"
 	tagTrueValue        = "true"
-)
+	tagK3sdeployImage   = "k3sdeployimage"
+	tagK3sdeployAMI     = "k3sdeployami"
 
-// describeAmi uses a set of filters to determine what AMI ID to use for latest amzn linux v2
-func describeAMI(client *ec2.Client) string {
-	// inputs
-	var name = "name"
-	var state = "state"
-	var architecture = "architecture"
-	var ownerAlias = "owner-alias"
-	var platform = "platform-details"
-
-	imagesInput := &ec2.DescribeImagesInput{
-		//Owners: "137112412989"
-		Filters: []types.Filter{
-			{
-				Name:   &name,
-				Values: []string{"amzn2-ami-hvm*"},
-			},
-			{
-				Name:   &state,
-				Values: []string{"available"},
-			},
-			{
-				Name:   &architecture,
-				Values: []string{"x86_64"},
-			},
-			{
-				Name:   &ownerAlias,
-				Values: []string{"amazon"},
-			},
-			{
-				Name:   &platform,
-				Values: []string{"Linux/UNIX"},
-			},
-		},
-	}
-
-	// Build the request with its input parameters
-	result, err := client.DescribeImages(context.TODO(), imagesInput)
-	if err != nil {
-		log.Fatalf("failed to get latest Amazon AMI ID, %v", err)
-	}
-
-	// get the ami result with latest creation date.
-	latest := result.Images[0]
-	fmt.Println("start", *latest.Name, *latest.ImageId, *latest.CreationDate)
-	for _, v := range result.Images {
-		if *latest.CreationDate < *v.CreationDate {
-			latest = v
-		}
-	}
-	return *latest.ImageId
-}
+	// labelWorkerGroup is the k3s node label holding the worker group of a worker
+	labelWorkerGroup = "k3sdeploy/worker-group"
+)
 
 // describeInstance returns instance ids created by this tool and associated with the cluster name
-func describeInstance(client *ec2.Client, k3scfg *cfg, name, idIn string) (ids []string, state []int32, ipPri, ipPub []string) {
+func describeInstance(client *ec2.Client, k3scfg *cfg, name, idIn string) (ids []string, state []int32, ipPri, ipPub []string, err error) {
 
 	// filter inputs must be prepended with "tag:"
 	var tagK3sdeploycluster = "tag:" + tagK3sdeploycluster
@@ -122,7 +77,7 @@ func describeInstance(client *ec2.Client, k3scfg *cfg, name, idIn string) (ids [
 
 	result, err := client.DescribeInstances(context.TODO(), describeInput)
 	if err != nil {
-		log.Fatalf("failed to describe instance, %v", err)
+		return nil, nil, nil, nil, fmt.Errorf("failed to describe instance, %v", err)
 	}
 
 	// loop over results to get matching instance id in a running state
@@ -151,7 +106,100 @@ func describeInstance(client *ec2.Client, k3scfg *cfg, name, idIn string) (ids [
 		}
 	}
 
-	return ids, state, ipPri, ipPub
+	return ids, state, ipPri, ipPub, nil
+}
+
+// installScript returns the start of the user data piping the k3s install script to sh,
+// running the preparation of the cluster image and then the shell lines of prep first
+func installScript(k3scfg *cfg, prep string) string {
+	return "#!/usr/bin/env bash\n" + osImages[k3scfg.image].prep + prep + "curl -sfL https://get.k3s.io"
+}
+
+// k3sVersionEnv returns the install script ENV variable pinning the k3s version, if one is set
+func k3sVersionEnv(k3scfg *cfg) string {
+	if k3scfg.k3sVersion == "" {
+		return ""
+	}
+	return "INSTALL_K3S_VERSION=" + k3scfg.k3sVersion + " "
+}
+
+// newClusterToken returns a random k3s cluster token shared by the server and agents
+func newClusterToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate cluster token, %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// saveClusterToken writes the cluster token to the cluster directory so nodes can be added later
+func saveClusterToken(k3scfg *cfg, token string) error {
+	dir, err := clusterDir(k3scfg.clusterName)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "node-token")
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write cluster token to %q, %v", path, err)
+	}
+	return nil
+}
+
+// serverArgs returns the k3s server args shared by every server, adding the API load
+// balancer, if any, to the serving certificate
+func serverArgs(k3scfg *cfg) string {
+	args := ""
+	if k3scfg.apiHost != "" {
+		args += " --tls-san " + k3scfg.apiHost
+	}
+	return args
+}
+
+// datastorePrep returns the user data lines that wait on pushDatastoreEndpoint to write the
+// endpoint of the external datastore, if any, and hand it to the install script, which keeps
+// it in the root only env file of the k3s service
+func datastorePrep(k3scfg *cfg) string {
+	if k3scfg.datastoreEndpoint == "" {
+		return ""
+	}
+	return "until [ -s " + datastoreEndpointPath + " ]; do sleep 5; done\n" +
+		"export K3S_DATASTORE_ENDPOINT=\"$(cat " + datastoreEndpointPath + ")\"\n"
+}
+
+// serverUserData returns the user data that installs the first k3s server with the cluster
+// token, initialising embedded etcd when the cluster has more than one server and no
+// external datastore
+func serverUserData(k3scfg *cfg, token string) string {
+	args := serverArgs(k3scfg)
+	if k3scfg.servers > 1 && k3scfg.datastoreEndpoint == "" {
+		args += " --cluster-init"
+	}
+	userData := installScript(k3scfg, datastorePrep(k3scfg)) + " | " + k3sVersionEnv(k3scfg) + "K3S_TOKEN=" + token + " sh -s - server" + args + "\n"
+	// the main deploys the spot interruption handler, the other servers share it through the datastore
+	if k3scfg.spotWorkers {
+		userData += spotHandlerDeploy()
+	}
+	return userData
+}
+
+// joinServerUserData returns the user data that installs a k3s server joining the embedded
+// etcd through the server or API load balancer at host, or sharing the external datastore if
+// there is one
+func joinServerUserData(k3scfg *cfg, token, host string) string {
+	if k3scfg.datastoreEndpoint != "" {
+		return installScript(k3scfg, datastorePrep(k3scfg)) + " | " + k3sVersionEnv(k3scfg) + "K3S_TOKEN=" + token + " sh -s - server" + serverArgs(k3scfg)
+	}
+	return installScript(k3scfg, "") + " | " + k3sVersionEnv(k3scfg) + "K3S_TOKEN=" + token + " sh -s - server --server https://" + net.JoinHostPort(host, k3sAPIPort) + serverArgs(k3scfg)
+}
+
+// agentUserData returns the user data that installs a k3s agent joining through the server or
+// API load balancer at host, labelled with its worker group if it has one
+func agentUserData(k3scfg *cfg, token, host, group string) string {
+	args := ""
+	if group != "" {
+		args = " --node-label " + labelWorkerGroup + "=" + group
+	}
+	return installScript(k3scfg, "") + " | " + k3sVersionEnv(k3scfg) + "K3S_URL=https://" + net.JoinHostPort(host, k3sAPIPort) + " K3S_TOKEN=" + token + " sh -s - agent" + args
 }
 
 // b64 base64 encodes a string
@@ -160,52 +208,101 @@ func b64(str string) *string {
 	return &enc
 }
 
-// tagInstance takes a slice of instanceIds and tags them
-func tagInstance(client *ec2.Client, instances []types.Instance, clusterName, name string) {
+// clusterTags returns the k3sdeploy tags for a resource called name followed by the
+// user defined tags of the cluster
+func clusterTags(k3scfg *cfg, name string) []types.Tag {
+	tags := []types.Tag{
+		{
+			Key:   aws.String(tagName),
+			Value: aws.String(name),
+		},
+		{
+			Key:   aws.String(tagK3sdeploycluster),
+			Value: aws.String(k3scfg.clusterName),
+		},
+		{
+			Key:   aws.String(tagSource),
+			Value: aws.String(tagSourceValue),
+		},
+		{
+			Key:   aws.String(tagK3sdeploy),
+			Value: aws.String(tagTrueValue),
+		},
+	}
+
+	// sort so resources are tagged in the same order every run
+	keys := make([]string, 0, len(k3scfg.tags))
+	for k := range k3scfg.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(k3scfg.tags[k]),
+		})
+	}
+
+	return tags
+}
+
+// instanceTags returns the tags of the instance called name launched from the AMI idAMI,
+// recording the image and AMI so the cluster can be reproduced
+func instanceTags(k3scfg *cfg, name, idAMI string) []types.Tag {
+	return append(clusterTags(k3scfg, name),
+		types.Tag{Key: aws.String(tagK3sdeployImage), Value: aws.String(k3scfg.image)},
+		types.Tag{Key: aws.String(tagK3sdeployAMI), Value: aws.String(idAMI)},
+	)
+}
+
+// launchTagSpecs returns the tag specifications tagging the instance called name and its
+// volumes at launch, so reconcile and delete find it even if the deploy dies right after
+func launchTagSpecs(k3scfg *cfg, name, idAMI string) []types.TagSpecification {
+	return append(volumeTagSpecs(k3scfg, name), types.TagSpecification{
+		ResourceType: types.ResourceTypeInstance,
+		Tags:         instanceTags(k3scfg, name, idAMI),
+	})
+}
+
+// tagInstance takes a slice of instanceIds and tags them, for instances launched untagged by
+// an older release
+func tagInstance(client *ec2.Client, instances []types.Instance, k3scfg *cfg, name string) error {
 
 	for _, v := range instances {
 		tagInput := &ec2.CreateTagsInput{
 			Resources: []string{*v.InstanceId},
-			Tags: []types.Tag{
-				{
-					Key:   &tagName,
-					Value: &name,
-				},
-				{
-					Key:   &tagK3sdeploycluster,
-					Value: &clusterName,
-				},
-				{
-					Key:   &tagSource,
-					Value: &tagSourceValue,
-				},
-				{
-					Key:   &tagK3sdeploy,
-					Value: &tagTrueValue,
-				},
-			},
+			Tags:      instanceTags(k3scfg, name, aws.ToString(v.ImageId)),
 		}
 
 		_, err := client.CreateTags(context.TODO(), tagInput)
 		if err != nil {
-			log.Fatalf("failed to tag instance, %v", err)
+			return fmt.Errorf("failed to tag instance %q, %v", *v.InstanceId, err)
 		}
 
 		log.Printf("Tagged instnace: %q\n", *v.InstanceId)
 
 	}
+	return nil
 }
 
-// createSGRules creates the needed rules on the instance SG
-func createSGRules(client *ec2.Client, id string) {
+// createSGRules creates the needed rules on the instance SG, opening the k3s API, etcd and
+// kubelet ports to vpcCIDRs, which also covers the load balancer health checks
+func createSGRules(client *ec2.Client, id string, vpcCIDRs []string) error {
 	// ingress
 
 	// ingress rules
 	proto := "TCP"
 
-	cidrs := []string{"10.0.0.0/8", "10.0.0.0/8", "10.0.0.0/8", "0.0.0.0/0"}
-	beginPorts := []int32{6443, 2379, 10250, 22}
-	endPorts := []int32{6443, 2380, 10250, 22}
+	var cidrs []string
+	var beginPorts, endPorts []int32
+	for _, cidr := range vpcCIDRs {
+		cidrs = append(cidrs, cidr, cidr, cidr)
+		beginPorts = append(beginPorts, 6443, 2379, 10250)
+		endPorts = append(endPorts, 6443, 2380, 10250)
+	}
+	cidrs = append(cidrs, "0.0.0.0/0")
+	beginPorts = append(beginPorts, 22)
+	endPorts = append(endPorts, 22)
 
 	for i, _ := range cidrs {
 		sgIngressInput := &ec2.AuthorizeSecurityGroupIngressInput{
@@ -216,9 +313,10 @@ func createSGRules(client *ec2.Client, id string) {
 			ToPort:     &endPorts[i],
 		}
 
+		// rules already exist when resuming a deploy
 		_, err := client.AuthorizeSecurityGroupIngress(context.TODO(), sgIngressInput)
-		if err != nil {
-			log.Fatalf("failed to create ingress security group rule, %v", err)
+		if err != nil && !isAPIError(err, "InvalidPermission.Duplicate") {
+			return fmt.Errorf("failed to create ingress security group rule, %v", err)
 		}
 	}
 
@@ -252,14 +350,15 @@ func createSGRules(client *ec2.Client, id string) {
 		}
 
 		_, err := client.AuthorizeSecurityGroupEgress(context.TODO(), sgEgressInput)
-		if err != nil {
-			log.Fatalf("failed to create egress security group rule, %v", err)
+		if err != nil && !isAPIError(err, "InvalidPermission.Duplicate") {
+			return fmt.Errorf("failed to create egress security group rule, %v", err)
 		}
 	}
+	return nil
 }
 
 // createSG creates the Security Group with needed SG input and output rules.
-func createSG(client *ec2.Client, clusterName, name, vpcID string) string {
+func createSG(client *ec2.Client, k3scfg *cfg, name, vpcID string) (string, error) {
 	sgName := name + "-sg"
 
 	// inputs for the SG (not the rules)
@@ -269,24 +368,7 @@ func createSG(client *ec2.Client, clusterName, name, vpcID string) string {
 		TagSpecifications: []types.TagSpecification{
 			{
 				ResourceType: types.ResourceType("security-group"),
-				Tags: []types.Tag{
-					{
-						Key:   &tagName,
-						Value: &sgName,
-					},
-					{
-						Key:   &tagK3sdeploycluster,
-						Value: &clusterName,
-					},
-					{
-						Key:   &tagSource,
-						Value: &tagSourceValue,
-					},
-					{
-						Key:   &tagK3sdeploy,
-						Value: &tagTrueValue,
-					},
-				},
+				Tags:         clusterTags(k3scfg, sgName),
 			},
 		},
 		VpcId: &vpcID,
@@ -295,19 +377,19 @@ func createSG(client *ec2.Client, clusterName, name, vpcID string) string {
 	// create SG (not rules)
 	result, err := client.CreateSecurityGroup(context.TODO(), sgInput)
 	if err != nil {
-		log.Fatalf("failed to create security group, %v", err)
+		return "", fmt.Errorf("failed to create security group, %v", err)
 	}
 
+	k3scfg.state.addSecurityGroup(*result.GroupId, sgName)
 	log.Printf("Created Security Group with ID: %q\n", *result.GroupId)
 
 	// TODO: stop returning one group ID as slice for RunInstancesInput
-	return *result.GroupId
+	return *result.GroupId, nil
 }
 
 // valSubnets validates subnet-ids exist
-func valSubnets(client *ec2.Client, k3scfg *cfg) (string, []string) {
-	// slice subnets
-	subnets := strings.Split(k3scfg.subnets, ",")
+func valSubnets(client *ec2.Client, k3scfg *cfg) (string, []string, error) {
+	subnets := k3scfg.subnets
 
 	// inputs for describe subnets
 	subnetsInput := &ec2.DescribeSubnetsInput{
@@ -317,117 +399,279 @@ func valSubnets(client *ec2.Client, k3scfg *cfg) (string, []string) {
 	// error if subnet is not found
 	result, err := client.DescribeSubnets(context.TODO(), subnetsInput)
 	if err != nil {
-		log.Fatalf("failed to describe subnet, %v", err)
+		return "", nil, fmt.Errorf("failed to describe subnet, %v", err)
 	}
 	for i := 0; i < len(result.Subnets); i++ {
 		if i+1 < len(result.Subnets) && *result.Subnets[i].VpcId != *result.Subnets[i+1].VpcId {
-			log.Fatalf("Specified subnets %q are not in the same VPC")
+			return "", nil, fmt.Errorf("Specified subnets %q are not in the same VPC", strings.Join(subnets, ","))
 		}
 	}
 	// return only the first VPC id since if subnets are in the same VPC the VPC ids will be the same.
-	return *result.Subnets[0].VpcId, subnets
+	return *result.Subnets[0].VpcId, subnets, nil
 }
 
-// createInstance creates count amount of EC2 instances and attempts to tag them
-func createCluster(awscfg aws.Config, k3scfg *cfg) {
-	// for debugging ssh
-	//_ = sshExtractToken(awscfg, k3scfg, "i-05d25082d445d76df", "i-018e690a621877f4d")
-	//return
+// vpcCIDRs returns the IPv4 CIDR blocks associated with the VPC with vpcID
+func vpcCIDRs(client *ec2.Client, vpcID string) ([]string, error) {
+	result, err := client.DescribeVpcs(context.TODO(), &ec2.DescribeVpcsInput{VpcIds: []string{vpcID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe VPC %q, %v", vpcID, err)
+	}
+
+	var cidrs []string
+	for _, v := range result.Vpcs {
+		for _, a := range v.CidrBlockAssociationSet {
+			if a.CidrBlock != nil && a.CidrBlockState != nil && a.CidrBlockState.State == types.VpcCidrBlockStateCodeAssociated {
+				cidrs = append(cidrs, *a.CidrBlock)
+			}
+		}
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no IPv4 CIDR block found for VPC %q", vpcID)
+	}
+	return cidrs, nil
+}
 
+// createCluster creates the bastion, security groups and count amount of EC2 instances and
+// attempts to tag them. Every resource is recorded in the cluster state as soon as it exists
+// so it can be rolled back if a later step fails. When resuming, the resources left by an
+// earlier deploy of the cluster are reused and only the missing ones are created.
+func createCluster(awscfg aws.Config, k3scfg *cfg, resume bool) error {
 	// print creating
 	log.Printf("Deploying internal cluster %q with %d instances.\n", k3scfg.clusterName, k3scfg.count)
 
 	// Using the Config value, create the s3 client
 	client := ec2.NewFromConfig(awscfg)
 
+	// start the state file before anything is created
+	var state *clusterState
+	var err error
+	if resume {
+		state, err = resumeClusterState(k3scfg, awscfg.Region)
+	} else {
+		state, err = newClusterState(k3scfg, awscfg.Region)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start cluster state, %v", err)
+	}
+	k3scfg.state = state
+
 	// validate subnet-ids
-	vpcID, subnets := valSubnets(client, k3scfg)
+	vpcID, subnets, err := valSubnets(client, k3scfg)
+	if err != nil {
+		return err
+	}
+
+	// fail before anything is created if an instance type isn't offered where it is placed
+	if err := valInstanceTypes(client, k3scfg, vpcID, subnets); err != nil {
+		return err
+	}
+
+	// find what an earlier deploy left behind
+	var existing *existingCluster
+	if resume {
+		if existing, err = discoverCluster(client, k3scfg, state, vpcID); err != nil {
+			return err
+		}
+	}
 
-	// find latest AMI
-	idAMI := describeAMI(client)
+	state.update(func(s *clusterState) {
+		s.VPC = vpcID
+	})
+
+	// find the AMI of every architecture and check it fits the instance types and volumes
+	if err := resolveAMIs(awscfg, k3scfg, state); err != nil {
+		return err
+	}
+	idAMI := k3scfg.amis[k3scfg.arch]
 
 	// create bastion
-	idBastion, ipBastion := createBastion(client, k3scfg, vpcID, idAMI)
+	idBastion, ipBastion, err := createBastion(client, k3scfg, vpcID, idAMI, existing)
+	if err != nil {
+		return err
+	}
+	if err := checkInterrupted(); err != nil {
+		return err
+	}
 
 	// create SGs for k3s
 	// https://rancher.com/docs/k3s/latest/en/installation/installation-requirements/#networking
-	idSG := createSG(client, k3scfg.clusterName, k3scfg.clusterName, vpcID)
+	idSG, ok := existing.securityGroup(k3scfg.clusterName + "-sg")
+	if ok {
+		log.Printf("Reusing Security Group with ID: %q\n", idSG)
+	} else if idSG, err = createSG(client, k3scfg, k3scfg.clusterName, vpcID); err != nil {
+		return err
+	}
 
 	// create SG rules for instances
-	createSGRules(client, idSG)
+	cidrs, err := vpcCIDRs(client, vpcID)
+	if err != nil {
+		return err
+	}
+	if err := createSGRules(client, idSG, cidrs); err != nil {
+		return err
+	}
 
 	log.Printf("Created Security Group ingress and egress rules on for Security Group with ID: %q\n", idSG)
-	// inputs
 
-	// use one for min and max since we want to create one instance at a time in each subnet
-	one := int32(1)
-	j := 0
-	userData := ""
-	ipClusterMain := ""
-	idClusterMain := ""
-	k3sClusterToken := ""
-
-	// loop over instance count and spread instances over the number of subnets provided.
-	for i := int32(1); i <= k3scfg.count; i++ {
-
-		// used in tagInstance to add to name a count of instances -01 -02 -03 etc
-		nameAppend := "-worker-0" + strconv.Itoa(int(i)-1)
-
-		// tag the first node as -main instead
-		if i == 1 {
-			nameAppend = "-main"
-			userData = k3sInstall + " | sh -"
-		} else {
-			userData = k3sInstall + " | K3S_URL=https://" + ipClusterMain + ":6443" + " K3S_TOKEN=" + k3sClusterToken + " sh -"
+	// the load balancer goes before the servers so its DNS name is in their certificate
+	var lb *stateLoadBalancer
+	lbClient := elb.NewFromConfig(awscfg)
+	if k3scfg.loadBalancer {
+		if lb, err = createLoadBalancer(client, lbClient, k3scfg, vpcID); err != nil {
+			return err
+		}
+		k3scfg.apiHost = lb.DNSName
+		if err := checkInterrupted(); err != nil {
+			return err
+		}
+	}
+
+	// the servers need the datastore endpoint in their user data so wait for it first
+	if k3scfg.datastore != "" {
+		if k3scfg.datastoreEndpoint, err = createDatastore(awscfg, k3scfg, vpcID, idSG, existing); err != nil {
+			return err
+		}
+		if err := checkInterrupted(); err != nil {
+			return err
 		}
+	}
 
-		runInput := &ec2.RunInstancesInput{
-			ImageId:          &idAMI,
-			InstanceType:     types.InstanceTypeT2Micro,
-			KeyName:          &k3scfg.key,
-			MinCount:         &one,
-			MaxCount:         &one,
-			SecurityGroupIds: []string{idSG},
-			SubnetId:         &subnets[j],
-			UserData:         b64(userData),
+	// the token is generated up front and passed to every node in user data so workers
+	// can be launched without waiting on the main to boot. Nodes of an earlier deploy
+	// already use the saved token.
+	var k3sClusterToken string
+	if resume {
+		if k3sClusterToken, err = loadClusterToken(k3scfg); err != nil {
+			return err
+		}
+	}
+	idClusterMain, mainExists := existing.instance(k3scfg.clusterName + "-main")
+	if k3sClusterToken == "" && mainExists {
+		return fmt.Errorf("the cluster token of %q is missing, workers can't join the existing main", k3scfg.clusterName)
+	}
+	if k3sClusterToken == "" {
+		if k3sClusterToken, err = newClusterToken(); err != nil {
+			return err
+		}
+		if err := saveClusterToken(k3scfg, k3sClusterToken); err != nil {
+			return err
 		}
+	}
+	if err := checkInterrupted(); err != nil {
+		return err
+	}
 
-		// Build the request with its input parameters
-		result, err := client.RunInstances(context.TODO(), runInput)
-		if err != nil {
-			log.Fatalf("failed to create instance, %v", err)
+	var ipClusterMain string
+	if mainExists {
+		ipClusterMain = *existing.instances[k3scfg.clusterName+"-main"].PrivateIpAddress
+		log.Printf("Reusing instance with ID: %q - PrivateIP: %q\n", idClusterMain, ipClusterMain)
+	} else if idClusterMain, ipClusterMain, err = runMain(client, k3scfg, idAMI, idSG, subnets[0], k3sClusterToken); err != nil {
+		return err
+	}
+
+	// nodes join through the API load balancer when there is one so they can rejoin while any
+	// server is up. The main is registered with it first so the joins reach the main.
+	joinHost := ipClusterMain
+	if lb != nil {
+		if err := registerServers(lbClient, lb, []string{idClusterMain}); err != nil {
+			return err
 		}
+		joinHost = lb.DNSName
+	}
 
-		// tag the instance after creation
-		for _, v := range result.Instances {
-			log.Printf("Created instnace with ID: %q - PrivateIP: %q\n", *v.InstanceId, *v.PrivateIpAddress)
-			if i == 1 {
-				ipClusterMain = *v.PrivateIpAddress
-				idClusterMain = *v.InstanceId
+	// launch the other servers, then the workers concurrently, spreading them over the
+	// subnets after the main
+	servers, workers := planNodes(k3scfg, subnets)
+	for i := range servers {
+		servers[i].userData = joinServerUserData(k3scfg, k3sClusterToken, joinHost)
+	}
+	for i := range workers {
+		workers[i].userData = agentUserData(k3scfg, k3sClusterToken, joinHost, workers[i].group)
+	}
+	for _, jobs := range [][]nodeJob{servers, workers} {
+		var missing []nodeJob
+		for _, job := range jobs {
+			if id, ok := existing.instance(job.name); ok {
+				log.Printf("Reusing %s %q with ID: %q\n", job.role, job.name, id)
+				continue
 			}
+			missing = append(missing, job)
 		}
+		if err := launchNodes(client, k3scfg, missing, idSG); err != nil {
+			return fmt.Errorf("failed to create nodes, %v", err)
+		}
+	}
 
-		tagInstance(client, result.Instances, k3scfg.clusterName, k3scfg.clusterName+nameAppend)
-
-		// extract token after cluster main is created
-		if i == 1 {
-			k3sClusterToken = sshExtractToken(awscfg, k3scfg, idBastion, idClusterMain)
+	// the servers wait on the datastore endpoint before installing k3s
+	if k3scfg.datastoreEndpoint != "" {
+		if err := pushDatastoreEndpoint(client, k3scfg, ipBastion); err != nil {
+			return err
 		}
+	}
+
+	// get the kubeconfig once the main has finished installing k3s
+	if err := fetchKubeConfig(awscfg, k3scfg, ipBastion, idClusterMain); err != nil {
+		return err
+	}
+
+	// only declare success once every node has joined
+	if err := waitNodesReady(client, k3scfg, ipBastion); err != nil {
+		return err
+	}
 
-		// get first (main) instance id
-		// if times iterated through subnets is equal to len of subnets, reset index j
-		// so that we can somewhat evenly spread instances to subnets.
-		if j+1 == len(subnets) {
-			j = 0
-		} else {
-			j++
+	// put the servers behind the load balancer, registering a target twice is a no-op
+	if lb != nil {
+		var ids []string
+		for _, v := range state.Instances {
+			if v.Role == "main" || v.Role == "server" {
+				ids = append(ids, v.ID)
+			}
+		}
+		if err := registerServers(lbClient, lb, ids); err != nil {
+			return err
+		}
+		if err := waitServersInService(lbClient, lb, ids); err != nil {
+			return err
 		}
 	}
 
-	fmt.Println("Run the following in one terminal to SSH forward via the bastion to the K3s cluster main.")
-	fmt.Printf("\nssh -NT -L 6443:%s:6443 ec2-user@%s\n", ipClusterMain, ipBastion)
-	fmt.Println("In another terminal run")
-	fmt.Println("Run 'KUBECONIFG=./k3s_kubeconfig kubectl config view' to get started.")
-	fmt.Println("or")
-	fmt.Println("Run 'kubectl --kubeconfig ./k3s_kubeconfig config view' to get started.")
+	log.Printf("Cluster %q is up with main %q behind bastion %q (%s).\n", k3scfg.clusterName, ipClusterMain, ipBastion, idBastion)
+	if lb != nil {
+		log.Printf("The k3s API is load balanced at %q.\n", "https://"+net.JoinHostPort(lb.DNSName, k3sAPIPort))
+	}
+	fmt.Println("Run the following in one terminal to forward the k3s API via the bastion, it updates ./k3s_kubeconfig to match.")
+	fmt.Printf("\n  k3sdeploy tunnel -k %s %s\n\n", k3scfg.keyPath, k3scfg.clusterName)
+	fmt.Println("In another terminal run 'KUBECONFIG=./k3s_kubeconfig kubectl get nodes' to get started.")
+	return nil
+}
+
+// runMain launches the cluster main in subnet
+func runMain(client *ec2.Client, k3scfg *cfg, idAMI, idSG, subnet, k3sClusterToken string) (id, ip string, err error) {
+	// use one for min and max since we want to create one instance at a time in each subnet
+	one := int32(1)
+	runInput := &ec2.RunInstancesInput{
+		ImageId:             &idAMI,
+		InstanceType:        types.InstanceType(k3scfg.serverType),
+		KeyName:             &k3scfg.key,
+		MinCount:            &one,
+		MaxCount:            &one,
+		SecurityGroupIds:    []string{idSG},
+		SubnetId:            &subnet,
+		UserData:            b64(serverUserData(k3scfg, k3sClusterToken)),
+		BlockDeviceMappings: rootVolumeMappings(k3scfg, "server", k3scfg.arch),
+		TagSpecifications:   launchTagSpecs(k3scfg, k3scfg.clusterName+"-main", idAMI),
+	}
+
+	// Build the request with its input parameters
+	result, err := client.RunInstances(context.TODO(), runInput)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create instance, %v", err)
+	}
+
+	id = *result.Instances[0].InstanceId
+	ip = *result.Instances[0].PrivateIpAddress
+	k3scfg.state.addInstance(result.Instances[0], k3scfg.clusterName+"-main", "main")
+	log.Printf("Created instnace with ID: %q - PrivateIP: %q\n", id, ip)
+
+	return id, ip, nil
 }
@@ -3,8 +3,16 @@ module k3sdeploy
 go 1.16
 
 require (
-	github.com/aws/aws-sdk-go-v2 v1.8.0
+	github.com/aws/aws-sdk-go-v2 v1.17.3
 	github.com/aws/aws-sdk-go-v2/config v1.4.1
-	github.com/aws/aws-sdk-go-v2/service/ec2 v1.13.0
+	github.com/aws/aws-sdk-go-v2/credentials v1.3.0
+	github.com/aws/aws-sdk-go-v2/service/ec2 v1.77.0
+	github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2 v1.6.0
+	github.com/aws/aws-sdk-go-v2/service/rds v1.7.0
+	github.com/aws/aws-sdk-go-v2/service/ssm v1.9.0
 	github.com/aws/aws-sdk-go-v2/service/sts v1.5.0
+	github.com/aws/smithy-go v1.13.5
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// markers cloud-init prints around the instance host public keys on the serial console
+const (
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// errHostKeyNotPinned is returned by knownHostsCallback when no host keys are pinned yet
+var errHostKeyNotPinned = errors.New("no pinned host keys")
+
+// clusterDir returns the local directory holding the files of the cluster, creating it if needed
+func clusterDir(clusterName string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory, %v", err)
+	}
+
+	dir := filepath.Join(home, ".k3sdeploy", clusterName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create cluster directory %q, %v", dir, err)
+	}
+	return dir, nil
+}
+
+// knownHostsPath returns the path of the per cluster known_hosts file
+func knownHostsPath(clusterName string) (string, error) {
+	dir, err := clusterDir(clusterName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "known_hosts"), nil
+}
+
+// knownHostsCallback verifies host keys against the known_hosts file at path. The file is
+// re-read on every connection so keys pinned after the callback was created are used, and
+// hosts missing from the file are rejected the same as mismatched keys.
+func knownHostsCallback(path string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return fmt.Errorf("knownhosts: key is unknown, %w in %q", errHostKeyNotPinned, path)
+		}
+		cb, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("knownhosts: failed to read %q, %v", path, err)
+		}
+		return cb(hostname, remote, key)
+	}
+}
+
+// parseConsoleHostKeys returns the host public keys printed by cloud-init in console output
+func parseConsoleHostKeys(output string) (keys []ssh.PublicKey) {
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, hostKeysBegin):
+			// a reboot prints the block again so only keep the latest one
+			inBlock = true
+			keys = nil
+			continue
+		case strings.Contains(line, hostKeysEnd):
+			inBlock = false
+			continue
+		case !inBlock:
+			continue
+		}
+
+		// console lines can be prefixed, e.g. with "ec2: ", so start at the key type
+		for _, prefix := range []string{"ssh-", "ecdsa-"} {
+			if i := strings.Index(line, prefix); i >= 0 {
+				key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line[i:]))
+				if err == nil {
+					keys = append(keys, key)
+				}
+				break
+			}
+		}
+	}
+
+	return keys
+}
+
+// getConsoleOutput returns the decoded console output of instance id, empty if there is none yet
+func getConsoleOutput(client *ec2.Client, id string) (string, error) {
+	// latest output is only supported on nitro instances so fall back to the cached output
+	result, err := client.GetConsoleOutput(context.TODO(), &ec2.GetConsoleOutputInput{
+		InstanceId: &id,
+		Latest:     aws.Bool(true),
+	})
+	if err != nil {
+		result, err = client.GetConsoleOutput(context.TODO(), &ec2.GetConsoleOutputInput{
+			InstanceId: &id,
+		})
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get console output of instance %q, %v", id, err)
+	}
+	if result.Output == nil {
+		return "", nil
+	}
+
+	output, err := base64.StdEncoding.DecodeString(*result.Output)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode console output of instance %q, %v", id, err)
+	}
+
+	return string(output), nil
+}
+
+// getConsoleHostKeys reads the host keys of instance id from its console output
+func getConsoleHostKeys(client *ec2.Client, id string) ([]ssh.PublicKey, error) {
+	output, err := getConsoleOutput(client, id)
+	if err != nil {
+		return nil, err
+	}
+	return parseConsoleHostKeys(output), nil
+}
+
+// pinHostKeys writes keys for host to the known_hosts file at path, replacing any keys
+// previously pinned for host since private and public IPs are reused by EC2
+func pinHostKeys(path, host string, keys []ssh.PublicKey) error {
+	pattern := knownhosts.Normalize(host)
+
+	var lines []string
+	if data, err := ioutil.ReadFile(path); err == nil {
+		for _, v := range strings.Split(string(data), "\n") {
+			if v == "" || strings.HasPrefix(v, pattern+" ") {
+				continue
+			}
+			lines = append(lines, v)
+		}
+	}
+	for _, k := range keys {
+		lines = append(lines, knownhosts.Line([]string{pattern}, k))
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// isHostPinned reports whether the known_hosts file at path has keys for host
+func isHostPinned(path, host string) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	pattern := knownhosts.Normalize(host) + " "
+	for _, v := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(v, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitHostKeys polls the console output of instance id until cloud-init has printed the
+// host keys and pins them for host in the cluster known_hosts file. Console output can take
+// several minutes to show up on non-nitro instances.
+func waitHostKeys(client *ec2.Client, k3scfg *cfg, id, host string) error {
+	log.Printf("Waiting on host keys of instance %q from console output.\n", id)
+
+	var keys []ssh.PublicKey
+	var err error
+	numChecks := 60
+	for i := 1; i <= numChecks; i++ {
+		keys, err = getConsoleHostKeys(client, id)
+		if len(keys) > 0 {
+			break
+		}
+		if err := sleep(time.Second * 10); err != nil {
+			return err
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("failed to get host keys of instance %q from console output, %v", id, err)
+	}
+
+	path, err := knownHostsPath(k3scfg.clusterName)
+	if err != nil {
+		return err
+	}
+	if err := pinHostKeys(path, host, keys); err != nil {
+		return fmt.Errorf("failed to pin host keys of instance %q, %v", id, err)
+	}
+
+	log.Printf("Pinned %d host keys of instance %q for %q.\n", len(keys), id, host)
+	return nil
+}
+
+// ensureHostKeys pins the host keys of instance id for host unless they are already pinned,
+// e.g. when the cluster was created from another machine
+func ensureHostKeys(client *ec2.Client, k3scfg *cfg, id, host string) error {
+	path, err := knownHostsPath(k3scfg.clusterName)
+	if err != nil {
+		return err
+	}
+	if isHostPinned(path, host) {
+		return nil
+	}
+	return waitHostKeys(client, k3scfg, id, host)
+}
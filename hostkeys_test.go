@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testHostKeys returns an ed25519, an ecdsa and an rsa public key
+func testHostKeys(t *testing.T) (ed, ec, rs ssh.PublicKey) {
+	t.Helper()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ec, err = ssh.NewPublicKey(&ecKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs, err = ssh.NewPublicKey(&rsaKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	return newTestSigner(t).PublicKey(), ec, rs
+}
+
+// authorizedLine returns key as a line of cloud-init console output
+func authorizedLine(key ssh.PublicKey) string {
+	return "ec2: " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " root@ip-10-0-1-10\n"
+}
+
+// consoleBlock returns the host keys block cloud-init prints on the console for keys
+func consoleBlock(keys ...ssh.PublicKey) string {
+	out := "ec2: " + hostKeysBegin + "\n"
+	for _, k := range keys {
+		out += authorizedLine(k)
+	}
+	return out + "ec2: " + hostKeysEnd + "\n"
+}
+
+func TestParseConsoleHostKeys(t *testing.T) {
+	ed, ec, rs := testHostKeys(t)
+	_, newEC, _ := testHostKeys(t)
+
+	boot := "[    0.000000] Linux version 5.10.0\ncloud-init[1503]: Cloud-init v. 22.2.2 running 'modules:final'\n"
+	fingerprints := "ec2: -----BEGIN SSH HOST KEY FINGERPRINTS-----\nec2: 256 SHA256:2Vc3Kf0uP root@ip-10-0-1-10 (ECDSA)\nec2: -----END SSH HOST KEY FINGERPRINTS-----\n"
+
+	tests := []struct {
+		name   string
+		output string
+		want   []ssh.PublicKey
+	}{
+		{name: "empty output", output: ""},
+		{name: "no host keys block", output: boot + fingerprints},
+		{name: "keys outside the block are ignored", output: boot + authorizedLine(ed)},
+		{name: "mixed key types", output: boot + fingerprints + consoleBlock(ec, ed, rs) + "login: ", want: []ssh.PublicKey{ec, ed, rs}},
+		{name: "unparsable lines are skipped", output: "ec2: " + hostKeysBegin + "\nec2: ssh-ed25519 not-base64\n" + authorizedLine(ed) + "ec2: " + hostKeysEnd + "\n", want: []ssh.PublicKey{ed}},
+		{name: "only the latest block after a reboot", output: consoleBlock(ec, ed) + boot + consoleBlock(newEC), want: []ssh.PublicKey{newEC}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseConsoleHostKeys(tt.output)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d keys, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if string(got[i].Marshal()) != string(tt.want[i].Marshal()) {
+					t.Errorf("key %d is %s, want %s", i, got[i].Type(), tt.want[i].Type())
+				}
+			}
+		})
+	}
+}
+
+func TestKnownHostsCallback(t *testing.T) {
+	ed, ec, _ := testHostKeys(t)
+	changed, _, _ := testHostKeys(t)
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := pinHostKeys(path, "10.0.1.10", []ssh.PublicKey{ed, ec}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		host        string
+		key         ssh.PublicKey
+		wantErr     bool
+		wantUnknown bool
+	}{
+		{name: "pinned ed25519 key", path: path, host: "10.0.1.10", key: ed},
+		{name: "pinned ecdsa key", path: path, host: "10.0.1.10", key: ec},
+		{name: "changed key is rejected", path: path, host: "10.0.1.10", key: changed, wantErr: true},
+		{name: "unpinned host is rejected", path: path, host: "10.0.1.11", key: ed, wantErr: true, wantUnknown: true},
+		{name: "missing known_hosts is rejected", path: filepath.Join(t.TempDir(), "known_hosts"), host: "10.0.1.10", key: ed, wantErr: true, wantUnknown: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := &net.TCPAddr{IP: net.ParseIP(tt.host), Port: 22}
+			err := knownHostsCallback(tt.path)(net.JoinHostPort(tt.host, "22"), remote, tt.key)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error, %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected the key to be rejected")
+			}
+
+			// a changed key lists the pinned keys it doesn't match, an unknown host has none
+			var keyErr *knownhosts.KeyError
+			switch {
+			case errors.As(err, &keyErr):
+				if unknown := len(keyErr.Want) == 0; unknown != tt.wantUnknown {
+					t.Errorf("got unknown host %v, want %v, %v", unknown, tt.wantUnknown, err)
+				}
+			case errors.Is(err, errHostKeyNotPinned):
+				if !tt.wantUnknown {
+					t.Errorf("got no pinned host keys for a pinned host, %v", err)
+				}
+			default:
+				t.Errorf("got error %v, want a key error", err)
+			}
+		})
+	}
+}
+
+func TestPinHostKeys(t *testing.T) {
+	ed, ec, rs := testHostKeys(t)
+	newED, _, _ := testHostKeys(t)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	if err := pinHostKeys(path, "10.0.1.10", []ssh.PublicKey{ed, ec}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pinHostKeys(path, "52.1.2.3", []ssh.PublicKey{rs}); err != nil {
+		t.Fatal(err)
+	}
+	// the private IP is reused by a new instance with new keys
+	if err := pinHostKeys(path, "10.0.1.10", []ssh.PublicKey{newED}); err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]bool{"10.0.1.10": true, "52.1.2.3": true, "10.0.1.11": false} {
+		if got := isHostPinned(path, host); got != want {
+			t.Errorf("isHostPinned(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	tests := []struct {
+		host    string
+		key     ssh.PublicKey
+		wantErr bool
+	}{
+		{host: "10.0.1.10", key: newED},
+		{host: "10.0.1.10", key: ed, wantErr: true},
+		{host: "10.0.1.10", key: ec, wantErr: true},
+		{host: "52.1.2.3", key: rs},
+	}
+	cb := knownHostsCallback(path)
+	for _, tt := range tests {
+		remote := &net.TCPAddr{IP: net.ParseIP(tt.host), Port: 22}
+		err := cb(net.JoinHostPort(tt.host, "22"), remote, tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("host %q key %s: got error %v, want error %v", tt.host, tt.key.Type(), err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// osImage is an operating system the cluster nodes can run, with how to find its AMI, how to
+// log in to it and what it needs before k3s is installed
+type osImage struct {
+	// ssmParameters are the AWS published SSM parameters holding the latest AMI by architecture
+	ssmParameters map[string]string
+	// owner and namePattern find the latest AMI of the image with DescribeImages
+	owner       string
+	namePattern string
+	// sshUser is the default login user of the AMI
+	sshUser string
+	// prep is the user data run before the k3s install script
+	prep string
+}
+
+// defaultImage is the image used when none is set, the one k3sdeploy always used
+const defaultImage = "al2"
+
+// defaultArch is the architecture of instances when none is set
+const defaultArch = "x86_64"
+
+// defaultSSHUser is the login user of clusters without one recorded in their state
+const defaultSSHUser = "ec2-user"
+
+// osImages is the catalogue of images by the name used in the cluster spec
+var osImages = map[string]osImage{
+	// Amazon Linux 2
+	"al2": {
+		ssmParameters: map[string]string{
+			"x86_64": "/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-x86_64-gp2",
+			"arm64":  "/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-arm64-gp2",
+		},
+		owner:       "amazon",
+		namePattern: "amzn2-ami-hvm-*",
+		sshUser:     "ec2-user",
+	},
+	// Amazon Linux 2023, SELinux is permissive and k3s-selinux has no AL2023 package
+	"al2023": {
+		ssmParameters: map[string]string{
+			"x86_64": "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64",
+			"arm64":  "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-arm64",
+		},
+		owner:       "amazon",
+		namePattern: "al2023-ami-2023.*",
+		sshUser:     "ec2-user",
+		prep:        "export INSTALL_K3S_SKIP_SELINUX_RPM=true\n",
+	},
+	// Ubuntu 22.04 LTS by Canonical
+	"ubuntu": {
+		ssmParameters: map[string]string{
+			"x86_64": "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
+			"arm64":  "/aws/service/canonical/ubuntu/server/22.04/stable/current/arm64/hvm/ebs-gp2/ami-id",
+		},
+		owner:       "099720109477",
+		namePattern: "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-*-server-*",
+		sshUser:     "ubuntu",
+	},
+	// Debian 12 by the Debian cloud team, not every build ships curl
+	"debian": {
+		ssmParameters: map[string]string{
+			"x86_64": "/aws/service/debian/release/12/latest/amd64",
+			"arm64":  "/aws/service/debian/release/12/latest/arm64",
+		},
+		owner:       "136693071363",
+		namePattern: "debian-12-*",
+		sshUser:     "admin",
+		prep:        "command -v curl >/dev/null || { apt-get update && apt-get install -y curl; }\n",
+	},
+}
+
+// imageNames returns the names of the catalogue images in order, for usage and error text
+func imageNames() string {
+	names := make([]string, 0, len(osImages))
+	for k := range osImages {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// clusterArchs returns the architectures of the instances of the cluster, the one of the
+// bastion and servers first
+func clusterArchs(k3scfg *cfg) []string {
+	archs := []string{k3scfg.arch}
+	seen := map[string]bool{k3scfg.arch: true}
+	for _, g := range k3scfg.workerGroups {
+		if g.count > 0 && !seen[g.arch] {
+			seen[g.arch] = true
+			archs = append(archs, g.arch)
+		}
+	}
+	return archs
+}
+
+// clusterSSHUser returns the login user recorded in the state of the cluster, or the login
+// user of the default image for clusters created before it was recorded
+func clusterSSHUser(clusterName string) (string, error) {
+	state, err := loadClusterState(clusterName)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the ssh user, %v", err)
+	}
+	if state == nil || state.SSHUser == "" {
+		return defaultSSHUser, nil
+	}
+	return state.SSHUser, nil
+}
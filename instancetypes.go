@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// placement is an instance type of an architecture that a node role needs in a subnet
+type placement struct {
+	role         string
+	arch         string
+	instanceType string
+	subnet       string
+}
+
+// planPlacements returns where every instance of the cluster will be launched, the bastion in
+// bastionSubnet and the main in the first of subnets
+func planPlacements(k3scfg *cfg, bastionSubnet string, subnets []string) []placement {
+	placements := []placement{
+		{"bastion", k3scfg.arch, k3scfg.bastionType, bastionSubnet},
+		{"server", k3scfg.arch, k3scfg.serverType, subnets[0]},
+	}
+
+	servers, workers := planNodes(k3scfg, subnets)
+	for _, v := range append(servers, workers...) {
+		role := v.role
+		if v.group != "" {
+			role = fmt.Sprintf("worker group %q", v.group)
+		}
+		placements = append(placements, placement{role, v.arch, v.instanceType, v.subnet})
+	}
+	return placements
+}
+
+// describeOfferings returns the instance types offered in each of azs, keyed by type and AZ
+func describeOfferings(client *ec2.Client, instanceTypes, azs []string) (map[string]bool, error) {
+	var filterType = "instance-type"
+	var filterLocation = "location"
+
+	offeringsInput := &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: types.LocationTypeAvailabilityZone,
+		Filters: []types.Filter{
+			{
+				Name:   &filterType,
+				Values: instanceTypes,
+			},
+			{
+				Name:   &filterLocation,
+				Values: azs,
+			},
+		},
+	}
+
+	offered := map[string]bool{}
+	paginator := ec2.NewDescribeInstanceTypeOfferingsPaginator(client, offeringsInput)
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instance type offerings, %v", err)
+		}
+		for _, v := range result.InstanceTypeOfferings {
+			offered[string(v.InstanceType)+"/"+*v.Location] = true
+		}
+	}
+	return offered, nil
+}
+
+// describeArchitectures returns the architectures supported by each of instanceTypes, keyed by
+// type and architecture
+func describeArchitectures(client *ec2.Client, instanceTypes []string) (map[string]bool, error) {
+	typesInput := &ec2.DescribeInstanceTypesInput{}
+	for _, v := range instanceTypes {
+		typesInput.InstanceTypes = append(typesInput.InstanceTypes, types.InstanceType(v))
+	}
+
+	supported := map[string]bool{}
+	paginator := ec2.NewDescribeInstanceTypesPaginator(client, typesInput)
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instance types, %v", err)
+		}
+		for _, v := range result.InstanceTypes {
+			if v.ProcessorInfo == nil {
+				continue
+			}
+			for _, arch := range v.ProcessorInfo.SupportedArchitectures {
+				supported[string(v.InstanceType)+"/"+string(arch)] = true
+			}
+		}
+	}
+	return supported, nil
+}
+
+// valInstanceTypes validates that the bastion, server and worker group instance types are
+// offered in the availability zone of every subnet they will be launched in and support the
+// architecture of their AMI
+func valInstanceTypes(client *ec2.Client, k3scfg *cfg, vpcID string, subnets []string) error {
+	bastionSubnets, err := getPublicSubnets(client, k3scfg, vpcID)
+	if err != nil {
+		return err
+	}
+	placements := planPlacements(k3scfg, bastionSubnets[0], subnets)
+
+	result, err := client.DescribeSubnets(context.TODO(), &ec2.DescribeSubnetsInput{
+		SubnetIds: append([]string{bastionSubnets[0]}, subnets...),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe subnet, %v", err)
+	}
+	azs := map[string]string{}
+	for _, v := range result.Subnets {
+		azs[*v.SubnetId] = *v.AvailabilityZone
+	}
+
+	var instanceTypes, zones []string
+	seen := map[string]bool{}
+	for _, v := range placements {
+		if !seen[v.instanceType] {
+			seen[v.instanceType] = true
+			instanceTypes = append(instanceTypes, v.instanceType)
+		}
+		if az := azs[v.subnet]; !seen[az] {
+			seen[az] = true
+			zones = append(zones, az)
+		}
+	}
+
+	offered, err := describeOfferings(client, instanceTypes, zones)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	reported := map[string]bool{}
+	for _, v := range placements {
+		az := azs[v.subnet]
+		msg := fmt.Sprintf("%s instance type %q is not offered in %s (%s)", v.role, v.instanceType, az, v.subnet)
+		if offered[v.instanceType+"/"+az] || reported[msg] {
+			continue
+		}
+		reported[msg] = true
+		missing = append(missing, msg)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("invalid instance types:\n  - %s", strings.Join(missing, "\n  - "))
+	}
+
+	// every type exists now that it is offered
+	supported, err := describeArchitectures(client, instanceTypes)
+	if err != nil {
+		return err
+	}
+	for _, v := range placements {
+		msg := fmt.Sprintf("%s instance type %q doesn't support the %s architecture", v.role, v.instanceType, v.arch)
+		if supported[v.instanceType+"/"+v.arch] || reported[msg] {
+			continue
+		}
+		reported[msg] = true
+		missing = append(missing, msg)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("invalid instance types:\n  - %s", strings.Join(missing, "\n  - "))
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// hourlyPrices are the us-east-1 on-demand Linux prices in USD of common instance types,
+// used to estimate the cost of a cluster. Other regions are usually a little more expensive.
+var hourlyPrices = map[string]float64{
+	"t2.nano":    0.0058,
+	"t2.micro":   0.0116,
+	"t2.small":   0.023,
+	"t2.medium":  0.0464,
+	"t2.large":   0.0928,
+	"t2.xlarge":  0.1856,
+	"t3.nano":    0.0052,
+	"t3.micro":   0.0104,
+	"t3.small":   0.0208,
+	"t3.medium":  0.0416,
+	"t3.large":   0.0832,
+	"t3.xlarge":  0.1664,
+	"t3a.micro":  0.0094,
+	"t3a.small":  0.0188,
+	"t3a.medium": 0.0376,
+	"t3a.large":  0.0752,
+	"m5.large":   0.096,
+	"m5.xlarge":  0.192,
+	"m5.2xlarge": 0.384,
+	"c5.large":   0.085,
+	"c5.xlarge":  0.17,
+	"r5.large":   0.126,
+	"r5.xlarge":  0.252,
+	"t4g.nano":   0.0042,
+	"t4g.micro":  0.0084,
+	"t4g.small":  0.0168,
+	"t4g.medium": 0.0336,
+	"t4g.large":  0.0672,
+	"t4g.xlarge": 0.1344,
+	"m6g.large":  0.077,
+	"m6g.xlarge": 0.154,
+	"c6g.large":  0.068,
+	"c6g.xlarge": 0.136,
+	"r6g.large":  0.1008,
+}
+
+// tagValue returns the value of the tag with key or an empty string
+func tagValue(tags []types.Tag, key string) string {
+	for _, v := range tags {
+		if v.Key != nil && *v.Key == key && v.Value != nil {
+			return *v.Value
+		}
+	}
+	return ""
+}
+
+// clusterSummary is a cluster found by the k3sdeploy tags in one region
+type clusterSummary struct {
+	Name           string         `json:"name"`
+	Region         string         `json:"region"`
+	Nodes          int            `json:"nodes"`
+	States         map[string]int `json:"states"`
+	BastionIP      string         `json:"bastionIp,omitempty"`
+	LaunchedAt     *time.Time     `json:"launchedAt,omitempty"`
+	InstanceTypes  map[string]int `json:"instanceTypes"`
+	SecurityGroups int            `json:"securityGroups"`
+	HourlyCost     float64        `json:"hourlyCost"`
+	UnpricedTypes  []string       `json:"unpricedTypes,omitempty"`
+}
+
+// summary returns the summary of the cluster name, adding it to clusters if it is new
+func summary(clusters map[string]*clusterSummary, name, region string) *clusterSummary {
+	c, ok := clusters[name]
+	if !ok {
+		c = &clusterSummary{
+			Name:          name,
+			Region:        region,
+			States:        map[string]int{},
+			InstanceTypes: map[string]int{},
+		}
+		clusters[name] = c
+	}
+	return c
+}
+
+// addInstance adds a non terminated instance of the cluster to the summary
+func (c *clusterSummary) addInstance(v types.Instance) {
+	state := instanceStates[*v.State.Code]
+	c.States[state]++
+
+	if tagValue(v.Tags, tagName) == c.Name+"-bastion" {
+		c.BastionIP = aws.ToString(v.PublicIpAddress)
+	} else {
+		c.Nodes++
+	}
+
+	if v.LaunchTime != nil && (c.LaunchedAt == nil || v.LaunchTime.Before(*c.LaunchedAt)) {
+		t := *v.LaunchTime
+		c.LaunchedAt = &t
+	}
+
+	instanceType := string(v.InstanceType)
+	c.InstanceTypes[instanceType]++
+
+	// only instances that are up are billed, 0 - pending, 16 - running
+	if *v.State.Code != 0 && *v.State.Code != 16 {
+		return
+	}
+	price, ok := hourlyPrices[instanceType]
+	if !ok {
+		for _, t := range c.UnpricedTypes {
+			if t == instanceType {
+				return
+			}
+		}
+		c.UnpricedTypes = append(c.UnpricedTypes, instanceType)
+		sort.Strings(c.UnpricedTypes)
+		return
+	}
+	c.HourlyCost += price
+}
+
+// describeClusters returns every cluster with instances or security groups created by this
+// tool in the region of client, keyed by the cluster name tag
+func describeClusters(client *ec2.Client, region string) (map[string]*clusterSummary, error) {
+	// filter inputs must be prepended with "tag:"
+	var tagKey = "tag:" + tagK3sdeploy
+	filters := []types.Filter{
+		{
+			Name:   &tagKey,
+			Values: []string{tagTrueValue},
+		},
+	}
+
+	clusters := map[string]*clusterSummary{}
+	paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{Filters: filters})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances in %s, %v", region, err)
+		}
+		for _, v := range result.Reservations {
+			for _, k := range v.Instances {
+				// 48 - terminated
+				if *k.State.Code == 48 {
+					continue
+				}
+				summary(clusters, tagValue(k.Tags, tagK3sdeploycluster), region).addInstance(k)
+			}
+		}
+	}
+
+	result, err := client.DescribeSecurityGroups(context.TODO(), &ec2.DescribeSecurityGroupsInput{Filters: filters})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe security groups in %s, %v", region, err)
+	}
+	for _, v := range result.SecurityGroups {
+		summary(clusters, tagValue(v.Tags, tagK3sdeploycluster), region).SecurityGroups++
+	}
+
+	return clusters, nil
+}
+
+// describeRegions returns every region enabled in the account
+func describeRegions(client *ec2.Client) ([]string, error) {
+	result, err := client.DescribeRegions(context.TODO(), &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe regions, %v", err)
+	}
+
+	var regions []string
+	for _, v := range result.Regions {
+		regions = append(regions, *v.RegionName)
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+// formatStates formats instance counts per state, e.g. "2 running, 1 pending"
+func formatStates(states map[string]int) string {
+	if len(states) == 0 {
+		return "-"
+	}
+	var parts []string
+	for k, v := range states {
+		parts = append(parts, fmt.Sprintf("%d %s", v, k))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// formatTypes formats instance counts per type, e.g. "t3.medium x2, t2.micro x1"
+func formatTypes(instanceTypes map[string]int) string {
+	if len(instanceTypes) == 0 {
+		return "-"
+	}
+	var parts []string
+	for k, v := range instanceTypes {
+		parts = append(parts, fmt.Sprintf("%s x%d", k, v))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// formatAge formats the time since t, e.g. "3d4h", "5h12m" or "12m"
+func formatAge(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	d := time.Since(*t)
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dm", int(d.Minutes()))
+}
+
+// formatCost formats the estimated hourly cost, marking it with + when some types are unpriced
+func formatCost(c *clusterSummary) string {
+	cost := fmt.Sprintf("$%.4f", c.HourlyCost)
+	if len(c.UnpricedTypes) > 0 {
+		cost += "+"
+	}
+	return cost
+}
+
+// listClusters prints every cluster found in regions, the region of awscfg if there are none,
+// as a table or as JSON when output is json
+func listClusters(awscfg aws.Config, regions []string, output string) error {
+	if len(regions) == 0 {
+		regions = []string{awscfg.Region}
+	}
+
+	// query the regions concurrently since listing all of them one at a time is slow
+	var mu sync.Mutex
+	var errs multiError
+	var clusters []*clusterSummary
+	var wg sync.WaitGroup
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+
+			// Using the Config value, create the ec2 client for the region
+			client := ec2.NewFromConfig(awscfg, func(o *ec2.Options) {
+				o.Region = region
+			})
+			found, err := describeClusters(client, region)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			for _, v := range found {
+				clusters = append(clusters, v)
+			}
+		}(region)
+	}
+	wg.Wait()
+
+	// still print what was found when some regions failed, e.g. ones not enabled
+	for _, err := range errs {
+		log.Printf("%v", err)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Region != clusters[j].Region {
+			return clusters[i].Region < clusters[j].Region
+		}
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	if output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if clusters == nil {
+			clusters = []*clusterSummary{}
+		}
+		if err := enc.Encode(clusters); err != nil {
+			return fmt.Errorf("failed to encode clusters, %v", err)
+		}
+	} else if len(clusters) == 0 {
+		fmt.Println("No k3sdeploy clusters found.")
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "REGION\tCLUSTER\tNODES\tSTATE\tBASTION IP\tAGE\tTYPES\tSGS\tEST. COST/HR")
+		for _, v := range clusters {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%d\t%s\n", v.Region, v.Name, v.Nodes, formatStates(v.States), valueOr(v.BastionIP, "-"), formatAge(v.LaunchedAt), formatTypes(v.InstanceTypes), v.SecurityGroups, formatCost(v))
+		}
+		w.Flush()
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to list %d of %d regions", len(errs), len(regions))
+	}
+	return nil
+}
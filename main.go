@@ -7,126 +7,527 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
 )
 
 // documentation
 // https://aws.github.io/aws-sdk-go-v2/docs/code-examples/
 // https://pkg.go.dev/github.com/aws/aws-sdk-go-v2/service/ec2
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// exit codes returned by the subcommands
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
 // cfg is the config object for service
 type cfg struct {
-	count       int32
-	clusterName string
-	key         string
-	keyPath     string
-	subnets     string
-	del         bool
-}
-
-// getK3sConfig parses input flags to set config object for k3s
-func getK3sConfig() *cfg {
-	// define input flags, empty default values so that ENV vars can be
-	// used to set flags
-	count := flag.String("c", "", "The number of k3s cluster instances.")
-	name := flag.String("n", "", "The name of the k3s cluster")
-	key := flag.String("k", "", "The full path to the ssh key to ues when provisioning instances.")
-	subnets := flag.String("s", "", "Comma separated list of subnets-ids to place instances in.")
-	// delete input
-	delName := flag.String("d", "", "The name of the cluster to terminate.")
-
-	// usage function prints flags
-	usage := func() {
-		fmt.Printf("Usage:\n")
-		flag.PrintDefaults()
+	count        int32
+	servers      int32
+	clusterName  string
+	key          string
+	keyPath      string
+	subnets      []string
+	region       string
+	k3sVersion   string
+	tags         map[string]string
+	bastionType  string
+	serverType   string
+	workerGroups []workerGroup
+	spotWorkers  bool
+	spotMaxPrice string
+	spotFallback bool
+	rootVolumes  map[string]rootVolume
+	image        string
+	ami          string
+	sshUser      string
+	arch         string
+	parallelism  int
+	readyTimeout time.Duration
+	loadBalancer bool
+	apiHost      string
+	datastore    string
+	// datastoreEndpoint is the k3s --datastore-endpoint of the datastore once it is created
+	datastoreEndpoint string
+	// amis and rootDevices are the AMIs the instances are launched from and their root
+	// device names by architecture
+	amis        map[string]string
+	rootDevices map[string]string
+	sshConfig   *sshClientConfig
+	state       *clusterState
+}
+
+// command is a k3sdeploy subcommand with its own flag set and handler
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) int
+}
+
+// commands returns the subcommands in the order they are printed in the usage text
+func commands() []command {
+	return []command{
+		{"create", "create [-f <spec>] -c <count> -n <name> -k <key> -s <subnets>", "Create a k3s cluster and bastion.", runCreate},
+		{"delete", "delete <name>", "Destroy the instances, security groups, load balancer and datastore of a cluster.", runDelete},
+		{"list", "list [-regions r1,r2|all]", "List the k3sdeploy clusters in the account with their nodes, age and estimated cost.", runList},
+		{"status", "status [-k <key>] <name>", "Show the health of the instances and k3s nodes of a cluster.", runStatus},
+		{"kubeconfig", "kubeconfig -k <key> <name>", "Fetch the kubeconfig of a cluster from the cluster main.", runKubeconfig},
+		{"ssh", "ssh -k <key> <name> [node]", "Open an SSH session to a cluster node via the bastion.", runSSH},
+		{"tunnel", "tunnel -k <key> <name>", "Forward a local port to the k3s API via the bastion and point the kubeconfig at it.", runTunnelCmd},
+		{"version", "version", "Print the k3sdeploy version.", runVersion},
+	}
+}
+
+// usage prints the top level help text listing every subcommand
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n  k3sdeploy <command> [flags]\n\nCommands:\n")
+	for _, c := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'k3sdeploy <command> -h' for the flags of a command.\n")
+}
+
+// newFlagSet returns a flag set for the command c whose usage prints the command line and flags
+func newFlagSet(c command) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  k3sdeploy %s\n\n%s\n\nFlags:\n", c.usage, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// lookupCommand returns the subcommand with name
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands() {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// parseFlags parses args with fs and maps help and parse errors to exit codes. Flags may
+// follow the positional arguments, e.g. delete my-cluster -yes, which are left in fs.Args().
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return exitOK, false
+			}
+			return exitUsage, false
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		// everything after -- is positional
+		if parsed := len(args) - fs.NArg(); parsed > 0 && args[parsed-1] == "--" {
+			positional = append(positional, fs.Args()...)
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	fs.Parse(append([]string{"--"}, positional...))
+	return exitOK, true
+}
+
+// clusterNameArg returns the cluster name from the first positional argument
+// or the name flag, printing usage if neither is set
+func clusterNameArg(fs *flag.FlagSet, name string) (string, bool) {
+	if name == "" && fs.NArg() > 0 {
+		name = fs.Arg(0)
+	}
+	if name == "" {
+		fs.Usage()
+		fmt.Fprintf(fs.Output(), "\nmissing required cluster name.\n")
+		return "", false
 	}
+	return name, true
+}
+
+// getK3sConfig builds the config object for k3s from the spec file, ENV variables and
+// create flags, in increasing order of precedence
+func getK3sConfig(fs *flag.FlagSet, args []string) (*cfg, int) {
+	file := fs.String("f", "", "The path to a cluster spec file.")
+	defineSpecFlags(fs)
 
 	// parse inputted flags
-	flag.Parse()
+	if code, ok := parseFlags(fs, args); !ok {
+		return nil, code
+	}
+	// a value after a true or false flag is left over, e.g. the false of -spot-workers false
+	if fs.NArg() > 0 {
+		fs.Usage()
+		fmt.Fprintf(fs.Output(), "\nunexpected arguments %q, set true or false flags with -flag or -flag=false.\n", fs.Args())
+		return nil, exitUsage
+	}
 
-	// do delete if specified
-	if *delName != "" {
-		c := cfg{
-			clusterName: *delName,
-			del:         true,
+	spec := &clusterSpec{}
+	if *file != "" {
+		var err error
+		spec, err = loadSpec(*file)
+		if err != nil {
+			log.Printf("invalid cluster spec, %v\n", err)
+			return nil, exitUsage
 		}
-		return &c
 	}
 
-	// init some defaults
-	var ok bool
-	var n int32
+	if err := spec.applyEnv(); err != nil {
+		log.Printf("invalid cluster spec, %v\n", err)
+		return nil, exitUsage
+	}
+	if err := spec.applyFlags(fs); err != nil {
+		log.Printf("invalid cluster spec, %v\n", err)
+		return nil, exitUsage
+	}
+	spec.setDefaults()
+
+	if err := spec.validate(); err != nil {
+		fs.Usage()
+		log.Printf("invalid cluster spec, %v\n", err)
+		return nil, exitUsage
+	}
+
+	return spec.toCfg(), exitOK
+}
 
-	// if flag was not passed in get from ENV
-	if *count == "" {
-		envName := "K3S_COUNT"
-		*count, ok = os.LookupEnv(envName)
-		if !ok {
-			usage()
-			log.Fatalf("missing required input for %q from command line flag or ENV %q variable.\n", "count", envName)
+// keyName returns the EC2 key pair name from the path of the private key
+func keyName(keyPath string) string {
+	return strings.TrimSuffix(path.Base(keyPath), filepath.Ext(path.Base(keyPath)))
+}
+
+// loadSSHKey loads the ssh key at the key path of k3scfg, returning false if it can't be used.
+// Host keys are checked against the known_hosts file of the cluster. Without an ssh user the
+// one recorded when the cluster was created is used.
+func loadSSHKey(k3scfg *cfg) bool {
+	if k3scfg.sshUser == "" {
+		user, err := clusterSSHUser(k3scfg.clusterName)
+		if err != nil {
+			log.Printf("unable to use ssh key, %v", err)
+			return false
 		}
-		num, _ := strconv.Atoi(*count)
-		n = int32(num)
-	}
-	if *name == "" {
-		envName := "K3S_NAME"
-		*name, ok = os.LookupEnv(envName)
-		if !ok {
-			usage()
-			log.Fatalf("missing required input for %q from command line flag or ENV %q variable.\n", "name", envName)
+		k3scfg.sshUser = user
+	}
+	knownHosts, err := knownHostsPath(k3scfg.clusterName)
+	if err != nil {
+		log.Printf("unable to use ssh key, %v", err)
+		return false
+	}
+	sshcfg, err := newSSHClientConfig(k3scfg.keyPath, k3scfg.sshUser, knownHosts)
+	if err != nil {
+		log.Printf("unable to use ssh key, %v", err)
+		return false
+	}
+	k3scfg.sshConfig = sshcfg
+	return true
+}
+
+// runCreate is the handler for the create command
+func runCreate(args []string) int {
+	c, _ := lookupCommand("create")
+	fs := newFlagSet(c)
+	awsOpts := defineAWSFlags(fs, false)
+	resume := fs.Bool("resume", false, "Continue a failed deploy of the cluster, reusing the resources it already created.")
+	rollbackOnFailure := fs.Bool("rollback-on-failure", false, "Roll back every created resource without asking if the deploy fails.")
+	k3scfg, code := getK3sConfig(fs, args)
+	if k3scfg == nil {
+		return code
+	}
+
+	// auth using defaults with the spec region
+	awsOpts.region = k3scfg.region
+	awscfg := initAWS(awsOpts)
+
+	// show who is about to be billed
+	getCallerId(awscfg, os.Stdout)
+
+	// load the ssh key before anything is created so a bad key fails fast
+	if !loadSSHKey(k3scfg) {
+		return exitError
+	}
+
+	// create cluster, Ctrl-C stops at the next step so the deploy can be rolled back
+	stop := watchInterrupt()
+	err := createCluster(awscfg, k3scfg, *resume)
+	stop()
+	if err == nil {
+		return exitOK
+	}
+	log.Printf("failed to create cluster %q, %v", k3scfg.clusterName, err)
+
+	// nothing to roll back if the state could not even be started
+	if k3scfg.state == nil {
+		return exitError
+	}
+	if !*rollbackOnFailure && !confirmRollback(k3scfg) {
+		fmt.Printf("\nLeaving the created resources in place, run 'k3sdeploy delete %s' to remove them.\n", k3scfg.clusterName)
+		return exitError
+	}
+	if err := rollback(awscfg, k3scfg); err != nil {
+		log.Printf("failed to roll back cluster %q, %v", k3scfg.clusterName, err)
+	}
+	return exitError
+}
+
+// runDelete is the handler for the delete command
+func runDelete(args []string) int {
+	c, _ := lookupCommand("delete")
+	fs := newFlagSet(c)
+	awsOpts := defineAWSFlags(fs, true)
+	name := fs.String("n", "", "The name of the cluster to terminate.")
+	opts := deleteOptions{}
+	fs.BoolVar(&opts.yes, "yes", false, "Destroy without asking for confirmation, for automation.")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Only print the instances and security groups that would be destroyed.")
+	fs.StringVar(&opts.output, "output", outputText, "The format of the delete plan, text or json.")
+	fs.BoolVar(&opts.snapshot, "snapshot", false, "Take a final snapshot of the cluster datastore before deleting it.")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	clusterName, ok := clusterNameArg(fs, *name)
+	if !ok {
+		return exitUsage
+	}
+	// a second name is a typo, never a second cluster to destroy
+	if fs.NArg() > 1 || (*name != "" && fs.NArg() > 0) {
+		fs.Usage()
+		fmt.Fprintf(fs.Output(), "\nunexpected arguments %q.\n", fs.Args())
+		return exitUsage
+	}
+	switch opts.output {
+	case outputText:
+	case outputJSON:
+		// the prompts would end up in the JSON
+		if !opts.yes && !opts.dryRun {
+			fmt.Fprintf(fs.Output(), "-output json requires -yes or -dry-run.\n")
+			return exitUsage
 		}
+	default:
+		fmt.Fprintf(fs.Output(), "invalid -output %q, expected %q or %q.\n", opts.output, outputText, outputJSON)
+		return exitUsage
 	}
-	if *key == "" {
-		envName := "K3S_KEY"
-		*key, ok = os.LookupEnv("envName")
-		if !ok {
-			usage()
-			log.Fatalf("missing required input for %q from command line flag or ENV %q variable.\n", "key", envName)
+
+	awscfg := initAWS(awsOpts)
+
+	// show whose resources are about to be destroyed, keeping stdout for the JSON plan
+	if opts.output == outputJSON {
+		getCallerId(awscfg, os.Stderr)
+	} else {
+		getCallerId(awscfg, os.Stdout)
+	}
+
+	return terminateSequence(awscfg, &cfg{clusterName: clusterName}, opts)
+}
+
+// runList is the handler for the list command
+func runList(args []string) int {
+	c, _ := lookupCommand("list")
+	fs := newFlagSet(c)
+	awsOpts := defineAWSFlags(fs, true)
+	regionList := fs.String("regions", "", "Comma separated list of regions to list, or 'all' for every enabled region.")
+	output := fs.String("output", outputText, "The output format, text or json.")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *output != outputText && *output != outputJSON {
+		fmt.Fprintf(fs.Output(), "invalid -output %q, expected %q or %q.\n", *output, outputText, outputJSON)
+		return exitUsage
+	}
+
+	// any listed region will do to authenticate when no default region is configured
+	regions := splitList(*regionList)
+	if awsOpts.region == "" && len(regions) > 0 && regions[0] != "all" {
+		awsOpts.region = regions[0]
+	}
+	awscfg := initAWS(awsOpts)
+
+	if len(regions) == 1 && regions[0] == "all" {
+		var err error
+		if regions, err = describeRegions(ec2.NewFromConfig(awscfg)); err != nil {
+			log.Printf("%v", err)
+			return exitError
 		}
 	}
-	if *subnets == "" {
-		envName := "K3S_SUBNETS"
-		*subnets, ok = os.LookupEnv("envName")
-		if !ok {
-			usage()
-			log.Fatalf("missing required input for %q from command line flag or ENV %q variable.\n", "subnets", envName)
+
+	if err := listClusters(awscfg, regions, *output); err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// runStatus is the handler for the status command
+func runStatus(args []string) int {
+	c, _ := lookupCommand("status")
+	fs := newFlagSet(c)
+	awsOpts := defineAWSFlags(fs, true)
+	name := fs.String("n", "", "The name of the cluster.")
+	key := fs.String("k", "", "The full path to the ssh key used when provisioning instances, to include k3s node readiness.")
+	user := fs.String("user", "", "The ssh login user of the cluster instances, defaults to the one recorded when the cluster was created.")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	clusterName, ok := clusterNameArg(fs, *name)
+	if !ok {
+		return exitUsage
+	}
+
+	k3scfg := &cfg{clusterName: clusterName}
+	if *key != "" {
+		k3scfg.key, k3scfg.keyPath, k3scfg.sshUser = keyName(*key), *key, *user
+		if !loadSSHKey(k3scfg) {
+			return exitError
 		}
 	}
 
-	// convert count flag string to int32
-	num, _ := strconv.Atoi(*count)
-	n = int32(num)
+	healthy, err := clusterStatus(initAWS(awsOpts), k3scfg)
+	if err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+	if !healthy {
+		return exitError
+	}
+	return exitOK
+}
+
+// runKubeconfig is the handler for the kubeconfig command
+func runKubeconfig(args []string) int {
+	c, _ := lookupCommand("kubeconfig")
+	fs := newFlagSet(c)
+	awsOpts := defineAWSFlags(fs, true)
+	name := fs.String("n", "", "The name of the cluster.")
+	key := fs.String("k", "", "The full path to the ssh key used when provisioning instances.")
+	user := fs.String("user", "", "The ssh login user of the cluster instances, defaults to the one recorded when the cluster was created.")
+	out := fs.String("o", "./k3s_kubeconfig", "The path to write the kubeconfig to.")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	clusterName, ok := clusterNameArg(fs, *name)
+	if !ok {
+		return exitUsage
+	}
+	if *key == "" {
+		fs.Usage()
+		log.Printf("missing required input for %q.\n", "key")
+		return exitUsage
+	}
+
+	k3scfg := &cfg{clusterName: clusterName, key: keyName(*key), keyPath: *key, sshUser: *user}
+	if !loadSSHKey(k3scfg) {
+		return exitError
+	}
+	if err := writeKubeConfig(initAWS(awsOpts), k3scfg, *out); err != nil {
+		log.Printf("%v", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// runSSH is the handler for the ssh command
+func runSSH(args []string) int {
+	c, _ := lookupCommand("ssh")
+	fs := newFlagSet(c)
+	awsOpts := defineAWSFlags(fs, true)
+	key := fs.String("k", "", "The full path to the ssh key used when provisioning instances.")
+	user := fs.String("user", "", "The ssh login user of the cluster instances, defaults to the one recorded when the cluster was created.")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	clusterName, ok := clusterNameArg(fs, "")
+	if !ok {
+		return exitUsage
+	}
+	if *key == "" {
+		fs.Usage()
+		log.Printf("missing required input for %q.\n", "key")
+		return exitUsage
+	}
+
+	// default to the cluster main when no node is given
+	node := "main"
+	if fs.NArg() > 1 {
+		node = fs.Arg(1)
+	}
 
-	c := cfg{
-		count:       n,
-		clusterName: *name,
-		key:         strings.TrimSuffix(path.Base(*key), filepath.Ext(path.Base(*key))),
-		keyPath:     *key,
-		subnets:     *subnets,
+	k3scfg := &cfg{clusterName: clusterName, key: keyName(*key), keyPath: *key, sshUser: *user}
+	if !loadSSHKey(k3scfg) {
+		return exitError
+	}
+	if err := sshNode(initAWS(awsOpts), k3scfg, node); err != nil {
+		log.Printf("ssh session to %q ended with error, %v", node, err)
+		return exitError
 	}
-	return &c
+	return exitOK
 }
 
-func main() {
+// runTunnelCmd is the handler for the tunnel command
+func runTunnelCmd(args []string) int {
+	c, _ := lookupCommand("tunnel")
+	fs := newFlagSet(c)
+	awsOpts := defineAWSFlags(fs, true)
+	name := fs.String("n", "", "The name of the cluster.")
+	key := fs.String("k", "", "The full path to the ssh key used when provisioning instances.")
+	user := fs.String("user", "", "The ssh login user of the cluster instances, defaults to the one recorded when the cluster was created.")
+	port := fs.Int("p", 0, "The local port to listen on, 0 picks a free port.")
+	kubeconfig := fs.String("kubeconfig", "./k3s_kubeconfig", "The kubeconfig to point at the tunnel, fetched from the cluster main if it doesn't exist.")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	clusterName, ok := clusterNameArg(fs, *name)
+	if !ok {
+		return exitUsage
+	}
+	if *key == "" {
+		fs.Usage()
+		log.Printf("missing required input for %q.\n", "key")
+		return exitUsage
+	}
 
-	// parse commandline inputs
-	k3scfg := getK3sConfig()
+	k3scfg := &cfg{clusterName: clusterName, key: keyName(*key), keyPath: *key, sshUser: *user}
+	if !loadSSHKey(k3scfg) {
+		return exitError
+	}
+	if err := runTunnel(initAWS(awsOpts), k3scfg, *port, *kubeconfig); err != nil {
+		log.Printf("tunnel failed, %v", err)
+		return exitError
+	}
+	return exitOK
+}
 
-	// auth using defaults
-	awscfg := initAWS()
+// runVersion is the handler for the version command
+func runVersion(args []string) int {
+	fmt.Println("k3sdeploy", version)
+	return exitOK
+}
 
-	// print caller info for debug
-	//getCallerId(cfg)
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
 
-	// delete cluster
-	if k3scfg.del {
-		terminateSequence(awscfg, k3scfg)
+	switch os.Args[1] {
+	case "-h", "-help", "--help", "help":
+		usage()
+		os.Exit(exitOK)
 	}
 
-	// add gey to agent
-	go sshAgent(k3scfg.keyPath)
+	c, ok := lookupCommand(os.Args[1])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(exitUsage)
+	}
 
-	// create cluster
-	createCluster(awscfg, k3scfg)
+	os.Exit(c.run(os.Args[2:]))
 }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+)
+
+// elbMaxName is the longest name allowed for load balancers and target groups
+const elbMaxName = 32
+
+// elbName returns the name of the cluster load balancer or target group with suffix. Cluster
+// names too long for the 32 character limit are shortened and end in a hash of the full name
+// so clusters whose names share a long prefix don't get the same name.
+func elbName(k3scfg *cfg, suffix string) string {
+	name := k3scfg.clusterName
+	if max := elbMaxName - len(suffix) - 1; len(name) > max {
+		sum := sha256.Sum256([]byte(name))
+		hash := hex.EncodeToString(sum[:])[:8]
+		name = strings.TrimRight(name[:max-len(hash)-1], "-") + "-" + hash
+	}
+	return name + "-" + suffix
+}
+
+// elbTags converts the k3sdeploy tags of a resource called name to load balancer tags
+func elbTags(k3scfg *cfg, name string) (tags []elbtypes.Tag) {
+	for _, v := range clusterTags(k3scfg, name) {
+		tags = append(tags, elbtypes.Tag{Key: v.Key, Value: v.Value})
+	}
+	return tags
+}
+
+// elbTagValue returns the value of the load balancer tag with key or an empty string
+func elbTagValue(tags []elbtypes.Tag, key string) string {
+	for _, v := range tags {
+		if v.Key != nil && *v.Key == key && v.Value != nil {
+			return *v.Value
+		}
+	}
+	return ""
+}
+
+// checkELBCluster returns an error unless the load balancer or target group with arn is tagged
+// with the cluster. Creating one returns the existing one of the same name, which could be
+// another cluster's.
+func checkELBCluster(lbClient *elb.Client, k3scfg *cfg, arn, name string) error {
+	result, err := lbClient.DescribeTags(context.TODO(), &elb.DescribeTagsInput{ResourceArns: []string{arn}})
+	if err != nil {
+		return fmt.Errorf("failed to describe tags of %q, %v", name, err)
+	}
+	for _, v := range result.TagDescriptions {
+		if elbTagValue(v.Tags, tagK3sdeploycluster) == k3scfg.clusterName && elbTagValue(v.Tags, tagK3sdeploy) == tagTrueValue {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q already exists and doesn't belong to cluster %q", name, k3scfg.clusterName)
+}
+
+// subnetsPerAZ returns the first of subnets in each availability zone since a load
+// balancer takes at most one subnet per zone
+func subnetsPerAZ(client *ec2.Client, subnets []string) ([]string, error) {
+	result, err := client.DescribeSubnets(context.TODO(), &ec2.DescribeSubnetsInput{
+		SubnetIds: subnets,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe subnet, %v", err)
+	}
+
+	azs := map[string]string{}
+	for _, v := range result.Subnets {
+		azs[*v.SubnetId] = *v.AvailabilityZone
+	}
+
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range subnets {
+		if az := azs[id]; !seen[az] {
+			seen[az] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// createLoadBalancer creates the internal network load balancer of the k3s API with a TCP
+// target group on 6443 and a listener forwarding to it. The create calls are idempotent so a
+// resumed deploy gets back the load balancer it created before.
+func createLoadBalancer(client *ec2.Client, lbClient *elb.Client, k3scfg *cfg, vpcID string) (*stateLoadBalancer, error) {
+	subnets, err := subnetsPerAZ(client, k3scfg.subnets)
+	if err != nil {
+		return nil, err
+	}
+
+	port := int32(6443)
+	interval := int32(10)
+	threshold := int32(3)
+
+	// the target group is recorded before the load balancer is created so a rollback finds both
+	tgName := elbName(k3scfg, "api")
+	tg, err := lbClient.CreateTargetGroup(context.TODO(), &elb.CreateTargetGroupInput{
+		Name:                       &tgName,
+		Protocol:                   elbtypes.ProtocolEnumTcp,
+		Port:                       &port,
+		VpcId:                      &vpcID,
+		TargetType:                 elbtypes.TargetTypeEnumInstance,
+		HealthCheckProtocol:        elbtypes.ProtocolEnumTcp,
+		HealthCheckIntervalSeconds: &interval,
+		HealthyThresholdCount:      &threshold,
+		UnhealthyThresholdCount:    &threshold,
+		Tags:                       elbTags(k3scfg, tgName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create target group %q, %v", tgName, err)
+	}
+	if err := checkELBCluster(lbClient, k3scfg, *tg.TargetGroups[0].TargetGroupArn, tgName); err != nil {
+		return nil, err
+	}
+	lb := &stateLoadBalancer{TargetGroupARN: *tg.TargetGroups[0].TargetGroupArn}
+	k3scfg.state.update(func(s *clusterState) {
+		s.LoadBalancer = lb
+	})
+	log.Printf("Created target group %q.\n", tgName)
+
+	lbName := elbName(k3scfg, "api")
+	result, err := lbClient.CreateLoadBalancer(context.TODO(), &elb.CreateLoadBalancerInput{
+		Name:    &lbName,
+		Type:    elbtypes.LoadBalancerTypeEnumNetwork,
+		Scheme:  elbtypes.LoadBalancerSchemeEnumInternal,
+		Subnets: subnets,
+		Tags:    elbTags(k3scfg, lbName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create load balancer %q, %v", lbName, err)
+	}
+	if err := checkELBCluster(lbClient, k3scfg, *result.LoadBalancers[0].LoadBalancerArn, lbName); err != nil {
+		return nil, err
+	}
+	k3scfg.state.update(func(s *clusterState) {
+		lb.ARN = *result.LoadBalancers[0].LoadBalancerArn
+		lb.Name = lbName
+		lb.DNSName = *result.LoadBalancers[0].DNSName
+	})
+	log.Printf("Created load balancer %q - DNS: %q\n", lbName, lb.DNSName)
+
+	_, err = lbClient.CreateListener(context.TODO(), &elb.CreateListenerInput{
+		LoadBalancerArn: &lb.ARN,
+		Protocol:        elbtypes.ProtocolEnumTcp,
+		Port:            &port,
+		DefaultActions: []elbtypes.Action{
+			{
+				Type:           elbtypes.ActionTypeEnumForward,
+				TargetGroupArn: &lb.TargetGroupARN,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create listener of load balancer %q, %v", lbName, err)
+	}
+
+	return lb, nil
+}
+
+// registerServers registers the server instances with ids in the API target group
+func registerServers(lbClient *elb.Client, lb *stateLoadBalancer, ids []string) error {
+	var targets []elbtypes.TargetDescription
+	for i := range ids {
+		targets = append(targets, elbtypes.TargetDescription{Id: &ids[i]})
+	}
+
+	_, err := lbClient.RegisterTargets(context.TODO(), &elb.RegisterTargetsInput{
+		TargetGroupArn: &lb.TargetGroupARN,
+		Targets:        targets,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register servers with target group, %v", err)
+	}
+
+	log.Printf("Registered %d servers with load balancer %q.\n", len(ids), lb.Name)
+	return nil
+}
+
+// waitServersInService waits until every server with ids passes the target group health check
+func waitServersInService(lbClient *elb.Client, lb *stateLoadBalancer, ids []string) error {
+	var targets []elbtypes.TargetDescription
+	for i := range ids {
+		targets = append(targets, elbtypes.TargetDescription{Id: &ids[i]})
+	}
+
+	log.Printf("Waiting on load balancer %q health checks.\n", lb.Name)
+	waiter := elb.NewTargetInServiceWaiter(lbClient, func(o *elb.TargetInServiceWaiterOptions) {
+		o.MinDelay = 10 * time.Second
+		o.MaxDelay = 30 * time.Second
+	})
+	err := waiter.Wait(context.TODO(), &elb.DescribeTargetHealthInput{
+		TargetGroupArn: &lb.TargetGroupARN,
+		Targets:        targets,
+	}, 10*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed to wait on servers to pass the health checks of load balancer %q, %v", lb.Name, err)
+	}
+	return nil
+}
+
+// findLoadBalancers returns the load balancers and target groups tagged with the cluster name
+func findLoadBalancers(lbClient *elb.Client, k3scfg *cfg) (lbs []elbtypes.LoadBalancer, tgs []elbtypes.TargetGroup, err error) {
+	var arns []string
+	lbByARN := map[string]elbtypes.LoadBalancer{}
+	lbPaginator := elb.NewDescribeLoadBalancersPaginator(lbClient, &elb.DescribeLoadBalancersInput{})
+	for lbPaginator.HasMorePages() {
+		result, err := lbPaginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to describe load balancers, %v", err)
+		}
+		for _, v := range result.LoadBalancers {
+			arns = append(arns, *v.LoadBalancerArn)
+			lbByARN[*v.LoadBalancerArn] = v
+		}
+	}
+
+	tgByARN := map[string]elbtypes.TargetGroup{}
+	tgPaginator := elb.NewDescribeTargetGroupsPaginator(lbClient, &elb.DescribeTargetGroupsInput{})
+	for tgPaginator.HasMorePages() {
+		result, err := tgPaginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to describe target groups, %v", err)
+		}
+		for _, v := range result.TargetGroups {
+			arns = append(arns, *v.TargetGroupArn)
+			tgByARN[*v.TargetGroupArn] = v
+		}
+	}
+
+	// load balancers can't be filtered by tag so read the tags of every one, 20 at a time
+	for len(arns) > 0 {
+		n := 20
+		if len(arns) < n {
+			n = len(arns)
+		}
+		result, err := lbClient.DescribeTags(context.TODO(), &elb.DescribeTagsInput{ResourceArns: arns[:n]})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to describe load balancer tags, %v", err)
+		}
+		arns = arns[n:]
+
+		for _, v := range result.TagDescriptions {
+			if elbTagValue(v.Tags, tagK3sdeploycluster) != k3scfg.clusterName || elbTagValue(v.Tags, tagK3sdeploy) != tagTrueValue {
+				continue
+			}
+			if lb, ok := lbByARN[*v.ResourceArn]; ok {
+				lbs = append(lbs, lb)
+			}
+			if tg, ok := tgByARN[*v.ResourceArn]; ok {
+				tgs = append(tgs, tg)
+			}
+		}
+	}
+
+	sort.Slice(lbs, func(i, j int) bool { return *lbs[i].LoadBalancerArn < *lbs[j].LoadBalancerArn })
+	sort.Slice(tgs, func(i, j int) bool { return *tgs[i].TargetGroupArn < *tgs[j].TargetGroupArn })
+	return lbs, tgs, nil
+}
+
+// apiEndpoint returns the host:port of the API load balancer of the cluster, or an empty
+// string if the cluster has none
+func apiEndpoint(awscfg aws.Config, k3scfg *cfg) (string, error) {
+	lbs, _, err := findLoadBalancers(elb.NewFromConfig(awscfg), k3scfg)
+	if err != nil || len(lbs) == 0 {
+		return "", err
+	}
+	return net.JoinHostPort(*lbs[0].DNSName, k3sAPIPort), nil
+}
+
+// deleteLoadBalancers deletes the load balancers with lbARNs and then the target groups with
+// tgARNs, which can only be deleted once no listener uses them, returning the ARNs that could
+// not be deleted
+func deleteLoadBalancers(lbClient *elb.Client, lbARNs, tgARNs []string) (failed []string) {
+	var deleted []string
+	for _, arn := range lbARNs {
+		arn := arn
+		_, err := lbClient.DeleteLoadBalancer(context.TODO(), &elb.DeleteLoadBalancerInput{LoadBalancerArn: &arn})
+		if err != nil {
+			log.Printf("failed to delete load balancer %q, %v", arn, err)
+			failed = append(failed, arn)
+			continue
+		}
+		deleted = append(deleted, arn)
+		log.Printf("Deleting load balancer %q.\n", arn)
+	}
+
+	if len(deleted) > 0 {
+		waiter := elb.NewLoadBalancersDeletedWaiter(lbClient, func(o *elb.LoadBalancersDeletedWaiterOptions) {
+			o.MinDelay = 5 * time.Second
+			o.MaxDelay = 15 * time.Second
+		})
+		err := waiter.Wait(context.TODO(), &elb.DescribeLoadBalancersInput{LoadBalancerArns: deleted}, 5*time.Minute)
+		if err != nil {
+			log.Printf("failed to wait on load balancers to be deleted, %v", err)
+		}
+	}
+
+	for _, arn := range tgARNs {
+		arn := arn
+		var err error
+		delay := 2 * time.Second
+		for attempt := 1; attempt <= 6; attempt++ {
+			_, err = lbClient.DeleteTargetGroup(context.TODO(), &elb.DeleteTargetGroupInput{TargetGroupArn: &arn})
+			if err == nil || !isAPIError(err, "ResourceInUse") {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err != nil && !isAPIError(err, "TargetGroupNotFound") {
+			log.Printf("failed to delete target group %q, %v", arn, err)
+			failed = append(failed, arn)
+			continue
+		}
+		log.Printf("Deleted target group %q.\n", arn)
+	}
+
+	return failed
+}
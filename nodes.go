@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// consoleTailLines is how many lines of console output are shown for a node that didn't join
+const consoleTailLines = 20
+
+// k3sNode is a node as seen by the k3s API of a server
+type k3sNode struct {
+	name    string
+	ip      string
+	ready   bool
+	version string
+}
+
+// k3sNodeList is the part of 'kubectl get nodes -o json' used by k3sdeploy
+type k3sNodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Addresses []struct {
+				Type    string `json:"type"`
+				Address string `json:"address"`
+			} `json:"addresses"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+			NodeInfo struct {
+				KubeletVersion string `json:"kubeletVersion"`
+			} `json:"nodeInfo"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// parseK3sNodes returns the nodes in the output of 'kubectl get nodes -o json' keyed by
+// their internal IP, which is the private IP of the EC2 instance
+func parseK3sNodes(out []byte) (map[string]k3sNode, error) {
+	var list k3sNodeList
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse k3s nodes, %v", err)
+	}
+
+	nodes := map[string]k3sNode{}
+	for _, v := range list.Items {
+		node := k3sNode{name: v.Metadata.Name, version: v.Status.NodeInfo.KubeletVersion}
+		for _, a := range v.Status.Addresses {
+			if a.Type == "InternalIP" {
+				node.ip = a.Address
+			}
+		}
+		for _, c := range v.Status.Conditions {
+			if c.Type == "Ready" {
+				node.ready = c.Status == "True"
+			}
+		}
+		nodes[node.ip] = node
+	}
+
+	return nodes, nil
+}
+
+// getK3sNodes asks the k3s API on the server via the bastion for its nodes
+func getK3sNodes(sshcfg *sshClientConfig, ipBastion, ipServer string) (map[string]k3sNode, error) {
+	out, err := sshRun(sshcfg, ipBastion, ipServer, "sudo k3s kubectl get nodes -o json", 3, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get k3s nodes from k3s server %q via bastion %q, %v", ipServer, ipBastion, err)
+	}
+	return parseK3sNodes(out)
+}
+
+// getServerK3sNodes asks the k3s API of the first server that answers via the bastion for its
+// nodes, the main first, so they can be read while any server of a HA cluster is up
+func getServerK3sNodes(client *ec2.Client, k3scfg *cfg, ipBastion string) (map[string]k3sNode, error) {
+	ids, ips, err := lookupServers(client, k3scfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no server found for cluster %q", k3scfg.clusterName)
+	}
+
+	for i, ip := range ips {
+		if err = ensureHostKeys(client, k3scfg, ids[i], ip); err != nil {
+			log.Printf("skipping server %q, %v", ip, err)
+			continue
+		}
+		var nodes map[string]k3sNode
+		if nodes, err = getK3sNodes(k3scfg.sshConfig, ipBastion, ip); err == nil {
+			return nodes, nil
+		}
+		log.Printf("%v", err)
+	}
+	return nil, err
+}
+
+// consoleTail returns the last n lines of output
+func consoleTail(output string, n int) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// waitNodesReady polls the k3s API of the servers via the bastion until every server and
+// worker recorded in the cluster state is a Ready node, or k3scfg.readyTimeout passes. On
+// timeout the missing nodes are returned in the error after printing their console output tail.
+func waitNodesReady(client *ec2.Client, k3scfg *cfg, ipBastion string) error {
+	// the nodes expected to join by private ip, skipping instances of a resumed deploy that
+	// have since been terminated
+	live, err := describeInstancesByID(client, k3scfg.state.instanceIDs())
+	if err != nil {
+		return err
+	}
+	expected := map[string]stateInstance{}
+	for _, v := range k3scfg.state.Instances {
+		inst, ok := live[v.ID]
+		// 0 - pending, 16 - running
+		if v.Role == "bastion" || !ok || (*inst.State.Code != 0 && *inst.State.Code != 16) {
+			continue
+		}
+		v.PrivateIP = *inst.PrivateIpAddress
+		expected[v.PrivateIP] = v
+	}
+
+	log.Printf("Waiting up to %s on %d nodes to be Ready.\n", k3scfg.readyTimeout, len(expected))
+
+	var missing []stateInstance
+	lastReady := -1
+	deadline := time.Now().Add(k3scfg.readyTimeout)
+	for {
+		// a failed poll is retried, the servers can be busy while workers join
+		nodes, err := getServerK3sNodes(client, k3scfg, ipBastion)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+
+		missing = missing[:0]
+		for ip, v := range expected {
+			if node, ok := nodes[ip]; !ok || !node.ready {
+				missing = append(missing, v)
+			}
+		}
+		if ready := len(expected) - len(missing); ready != lastReady {
+			log.Printf("[%d/%d] nodes Ready.\n", ready, len(expected))
+			lastReady = ready
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		if err := sleep(time.Second * 10); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Name < missing[j].Name })
+	var names []string
+	for _, v := range missing {
+		names = append(names, fmt.Sprintf("%s (%s, %s)", v.Name, v.ID, v.PrivateIP))
+
+		output, err := getConsoleOutput(client, v.ID)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		fmt.Printf("\n%s%s (%s) console output:%s\n%s\n", boldText, v.Name, v.ID, resetText, valueOr(consoleTail(output, consoleTailLines), "(no console output yet)"))
+	}
+
+	return fmt.Errorf("%d of %d nodes were not Ready after %s: %s", len(missing), len(expected), k3scfg.readyTimeout, strings.Join(names, ", "))
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// existingCluster is what an earlier deploy of the cluster left behind. Instances are keyed
+// by their Name tag and security groups by their group name.
+type existingCluster struct {
+	instances      map[string]types.Instance
+	securityGroups map[string]types.SecurityGroup
+}
+
+// instance returns the id of the existing instance named name
+func (e *existingCluster) instance(name string) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	v, ok := e.instances[name]
+	if !ok {
+		return "", false
+	}
+	return *v.InstanceId, true
+}
+
+// securityGroup returns the id of the existing security group named name
+func (e *existingCluster) securityGroup(name string) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	v, ok := e.securityGroups[name]
+	if !ok {
+		return "", false
+	}
+	return *v.GroupId, true
+}
+
+// hasNodes reports whether any server or worker other than the main of the cluster exists
+func (e *existingCluster) hasNodes(k3scfg *cfg) bool {
+	if e == nil {
+		return false
+	}
+	for name := range e.instances {
+		if role := roleOf(k3scfg, name); role == "server" || role == "worker" {
+			return true
+		}
+	}
+	return false
+}
+
+// roleOf returns the node role of the instance named name
+func roleOf(k3scfg *cfg, name string) string {
+	switch {
+	case name == k3scfg.clusterName+"-bastion":
+		return "bastion"
+	case name == k3scfg.clusterName+"-main":
+		return "main"
+	case strings.HasPrefix(name, k3scfg.clusterName+"-server-"):
+		return "server"
+	}
+	return "worker"
+}
+
+// resumeClusterState loads the state of the deploy being resumed, starting a new one if the
+// earlier deploy died before writing any
+func resumeClusterState(k3scfg *cfg, region string) (*clusterState, error) {
+	state, err := loadClusterState(k3scfg.clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return newClusterState(k3scfg, region)
+	}
+
+	if state.Region != region {
+		return nil, fmt.Errorf("cluster %q was deployed to region %q, not %q", k3scfg.clusterName, state.Region, region)
+	}
+	if state.K3sVersion != k3scfg.k3sVersion {
+		return nil, fmt.Errorf("spec field %q: %q differs from %q used by the deploy being resumed", "k3sVersion", k3scfg.k3sVersion, state.K3sVersion)
+	}
+	// every node of a cluster runs the same AMI
+	if state.Image != "" && state.Image != k3scfg.image {
+		return nil, fmt.Errorf("spec field %q: %q differs from %q used by the deploy being resumed", "image", k3scfg.image, state.Image)
+	}
+	if state.AMI != "" && k3scfg.ami != "" && state.AMI != k3scfg.ami {
+		return nil, fmt.Errorf("spec field %q: %q differs from %q used by the deploy being resumed", "ami", k3scfg.ami, state.AMI)
+	}
+	// the main only runs embedded etcd if it was created with more than one server
+	if state.Servers != 0 && (state.Servers > 1) != (k3scfg.servers > 1) {
+		return nil, fmt.Errorf("spec field %q: %d differs from %d used by the deploy being resumed", "servers", k3scfg.servers, state.Servers)
+	}
+	// the load balancer DNS name is only in the certificate of servers created with it
+	for _, v := range state.Instances {
+		if v.Role == "main" && (state.LoadBalancer != nil) != k3scfg.loadBalancer {
+			return nil, fmt.Errorf("spec field %q: %t differs from %t used by the deploy being resumed", "loadBalancer", k3scfg.loadBalancer, state.LoadBalancer != nil)
+		}
+	}
+	// the main is pointed at the datastore, or not, when it is created
+	engine := ""
+	if state.Datastore != nil {
+		engine = state.Datastore.Engine
+	}
+	for _, v := range state.Instances {
+		if v.Role == "main" && engine != k3scfg.datastore {
+			return nil, fmt.Errorf("spec field %q: %q differs from %q used by the deploy being resumed", "datastore", k3scfg.datastore, engine)
+		}
+	}
+	state.update(func(s *clusterState) {
+		s.Subnets = k3scfg.subnets
+		s.Servers = k3scfg.servers
+	})
+
+	return state, nil
+}
+
+// describeClusterInstances returns the non terminated instances of the cluster found by
+// tags or recorded in the state
+func describeClusterInstances(client *ec2.Client, k3scfg *cfg, state *clusterState) (map[string]types.Instance, error) {
+	// filter inputs must be prepended with "tag:"
+	var tagK3sdeploycluster = "tag:" + tagK3sdeploycluster
+	var tagKey = "tag:" + tagK3sdeploy
+
+	describeInput := &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   &tagK3sdeploycluster,
+				Values: []string{k3scfg.clusterName},
+			},
+			{
+				Name:   &tagKey,
+				Values: []string{tagTrueValue},
+			},
+		},
+	}
+
+	instances := map[string]types.Instance{}
+	paginator := ec2.NewDescribeInstancesPaginator(client, describeInput)
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances, %v", err)
+		}
+		for _, v := range result.Reservations {
+			for _, k := range v.Instances {
+				instances[*k.InstanceId] = k
+			}
+		}
+	}
+
+	recorded, err := describeInstancesByID(client, state.instanceIDs())
+	if err != nil {
+		return nil, err
+	}
+	for id, v := range recorded {
+		instances[id] = v
+	}
+
+	// 48 - terminated
+	for id, v := range instances {
+		if *v.State.Code == 48 {
+			delete(instances, id)
+		}
+	}
+
+	return instances, nil
+}
+
+// describeClusterSGs returns the security groups of the cluster found by tags or recorded in
+// the state
+func describeClusterSGs(client *ec2.Client, k3scfg *cfg, state *clusterState) (map[string]types.SecurityGroup, error) {
+	// filter inputs must be prepended with "tag:"
+	var tagK3sdeploycluster = "tag:" + tagK3sdeploycluster
+	var tagKey = "tag:" + tagK3sdeploy
+	var groupID = "group-id"
+
+	inputs := []*ec2.DescribeSecurityGroupsInput{
+		{
+			Filters: []types.Filter{
+				{
+					Name:   &tagK3sdeploycluster,
+					Values: []string{k3scfg.clusterName},
+				},
+				{
+					Name:   &tagKey,
+					Values: []string{tagTrueValue},
+				},
+			},
+		},
+	}
+	if ids := state.securityGroupIDs(); len(ids) > 0 {
+		inputs = append(inputs, &ec2.DescribeSecurityGroupsInput{
+			Filters: []types.Filter{
+				{
+					Name:   &groupID,
+					Values: ids,
+				},
+			},
+		})
+	}
+
+	groups := map[string]types.SecurityGroup{}
+	for _, in := range inputs {
+		result, err := client.DescribeSecurityGroups(context.TODO(), in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe security groups, %v", err)
+		}
+		for _, v := range result.SecurityGroups {
+			groups[*v.GroupId] = v
+		}
+	}
+
+	return groups, nil
+}
+
+// discoverCluster finds the resources an earlier deploy of the cluster left behind, checks
+// they can be reused in vpcID and records any the state is missing. Instances whose tagging
+// failed are tagged again.
+func discoverCluster(client *ec2.Client, k3scfg *cfg, state *clusterState, vpcID string) (*existingCluster, error) {
+	instances, err := describeClusterInstances(client, k3scfg, state)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := describeClusterSGs(client, k3scfg, state)
+	if err != nil {
+		return nil, err
+	}
+
+	// the state knows the name of instances that never got their Name tag
+	recordedNames := map[string]string{}
+	if state != nil {
+		for _, v := range state.Instances {
+			recordedNames[v.ID] = v.Name
+		}
+	}
+
+	e := &existingCluster{
+		instances:      map[string]types.Instance{},
+		securityGroups: map[string]types.SecurityGroup{},
+	}
+
+	for id, v := range instances {
+		name := tagValue(v.Tags, tagName)
+		if name == "" {
+			name = recordedNames[id]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("instance %q of cluster %q has no name, delete the cluster and deploy again", id, k3scfg.clusterName)
+		}
+		if other, ok := e.instances[name]; ok {
+			return nil, fmt.Errorf("instances %q and %q are both named %q, terminate one of them first", *other.InstanceId, id, name)
+		}
+
+		// 0 - pending, 16 - running
+		if code := *v.State.Code; code != 0 && code != 16 {
+			return nil, fmt.Errorf("instance %q (%s) is %s, it must be running to resume", id, name, instanceStates[code])
+		}
+		if v.VpcId == nil || *v.VpcId != vpcID {
+			return nil, fmt.Errorf("instance %q (%s) is not in VPC %q of the spec subnets", id, name, vpcID)
+		}
+		if role := roleOf(k3scfg, name); (role == "server" || role == "worker") && !isNodeName(k3scfg, name) {
+			return nil, fmt.Errorf("%s %q is not one of the %d instances in the spec, terminate it or raise the count", role, name, k3scfg.count)
+		}
+		e.instances[name] = v
+	}
+
+	for id, v := range groups {
+		name := aws.ToString(v.GroupName)
+		if other, ok := e.securityGroups[name]; ok {
+			return nil, fmt.Errorf("security groups %q and %q are both named %q, delete one of them first", *other.GroupId, id, name)
+		}
+		if v.VpcId == nil || *v.VpcId != vpcID {
+			return nil, fmt.Errorf("security group %q (%s) is not in VPC %q of the spec subnets", id, name, vpcID)
+		}
+		e.securityGroups[name] = v
+	}
+
+	if _, ok := e.instance(k3scfg.clusterName + "-main"); !ok && e.hasNodes(k3scfg) {
+		return nil, fmt.Errorf("cluster %q has nodes but no main, delete the cluster and deploy again", k3scfg.clusterName)
+	}
+
+	// record anything found by tags only, bastion first so a rollback deletes in the usual order
+	recorded := map[string]bool{}
+	for _, id := range append(state.instanceIDs(), state.securityGroupIDs()...) {
+		recorded[id] = true
+	}
+	for _, name := range []string{k3scfg.clusterName + "-bastion-sg", k3scfg.clusterName + "-sg", k3scfg.clusterName + "-datastore-sg"} {
+		if id, ok := e.securityGroup(name); ok && !recorded[id] {
+			state.addSecurityGroup(id, name)
+		}
+	}
+	for name, v := range e.instances {
+		if !recorded[*v.InstanceId] {
+			state.addInstance(v, name, roleOf(k3scfg, name))
+		}
+		if tagValue(v.Tags, tagK3sdeploycluster) == "" {
+			log.Printf("Tagging instance %q again.\n", *v.InstanceId)
+			if err := tagInstance(client, []types.Instance{v}, k3scfg, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	log.Printf("Found %d instances and %d security groups of cluster %q to reuse.\n", len(e.instances), len(e.securityGroups), k3scfg.clusterName)
+	return e, nil
+}
+
+// isNodeName reports whether name is the Name tag of one of the extra servers or workers in the spec
+func isNodeName(k3scfg *cfg, name string) bool {
+	for i := 1; i < int(k3scfg.servers); i++ {
+		if name == serverName(k3scfg, i) {
+			return true
+		}
+	}
+	for i := 1; i <= int(k3scfg.count-k3scfg.servers); i++ {
+		if name == workerName(k3scfg, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverName returns the Name tag of server i, the first server is the main
+func serverName(k3scfg *cfg, i int) string {
+	return fmt.Sprintf("%s-server-%02d", k3scfg.clusterName, i+1)
+}
+
+// workerName returns the Name tag of worker i
+func workerName(k3scfg *cfg, i int) string {
+	return fmt.Sprintf("%s-worker-%02d", k3scfg.clusterName, i)
+}
+
+// loadClusterToken reads the cluster token saved by an earlier deploy, returning an empty
+// token if there is none
+func loadClusterToken(k3scfg *cfg) (string, error) {
+	dir, err := clusterDir(k3scfg.clusterName)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "node-token")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read cluster token %q, %v", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
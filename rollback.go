@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/smithy-go"
+)
+
+// errInterrupted is returned by the create steps once the deploy has been interrupted
+var errInterrupted = errors.New("interrupted")
+
+// interrupted is closed on the first Ctrl-C of a deploy
+var interrupted = make(chan struct{})
+
+// watchInterrupt closes interrupted on the first Ctrl-C or SIGTERM so the deploy stops at
+// the next step and can roll back. Signal handling is then reset so a second Ctrl-C kills
+// the process straight away. The returned func stops watching.
+func watchInterrupt() (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sigs:
+			signal.Stop(sigs)
+			log.Println("Interrupted, stopping after the current step. Press Ctrl-C again to exit immediately.")
+			close(interrupted)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// checkInterrupted returns errInterrupted once the deploy has been interrupted
+func checkInterrupted() error {
+	select {
+	case <-interrupted:
+		return errInterrupted
+	default:
+		return nil
+	}
+}
+
+// sleep waits for d, returning errInterrupted early if the deploy is interrupted
+func sleep(d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-interrupted:
+		return errInterrupted
+	case <-t.C:
+		return nil
+	}
+}
+
+// isAPIError reports whether err is an AWS API error with the error code
+func isAPIError(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
+
+// confirmRollback asks whether to roll back a failed deploy. Only 'YES' is accepted.
+func confirmRollback(k3scfg *cfg) bool {
+	usrInput := "NO"
+	fmt.Printf("\nThe deploy of cluster %q failed. Roll back every resource it created?\n", k3scfg.clusterName)
+	fmt.Printf("Only %s'YES'%s will be accepted.\n%s%sROLL BACK?%s:", boldText, resetText, boldText, redText, resetText)
+	fmt.Scanln(&usrInput)
+	return usrInput == "YES"
+}
+
+// rollback deletes the load balancer and datastore, terminates every instance and deletes
+// every security group recorded in the state of a failed deploy. The datastore is deleted
+// without a final snapshot since the deploy never got to use it. Resources that were removed
+// are dropped from the state so a later delete only sees what is left, and the cluster
+// directory is removed once nothing is left.
+func rollback(awscfg aws.Config, k3scfg *cfg) error {
+	// Using the Config value, create the ec2 client
+	client := ec2.NewFromConfig(awscfg)
+	state := k3scfg.state
+
+	log.Printf("Rolling back cluster %q.\n", k3scfg.clusterName)
+
+	if lb := state.LoadBalancer; lb != nil {
+		var arnsLB []string
+		if lb.ARN != "" {
+			arnsLB = append(arnsLB, lb.ARN)
+		}
+		if failed := deleteLoadBalancers(elb.NewFromConfig(awscfg), arnsLB, []string{lb.TargetGroupARN}); len(failed) > 0 {
+			return fmt.Errorf("failed to remove %q, run 'k3sdeploy delete %s' to retry", strings.Join(failed, ","), k3scfg.clusterName)
+		}
+		state.update(func(s *clusterState) {
+			s.LoadBalancer = nil
+		})
+	}
+
+	dbClient := rds.NewFromConfig(awscfg)
+	var idsDB []string
+	if db := state.Datastore; db != nil && db.Identifier != "" {
+		idsDB = append(idsDB, db.Identifier)
+	}
+	if err := deleteDatastores(dbClient, idsDB, false); err != nil {
+		return fmt.Errorf("%v, run 'k3sdeploy delete %s' to retry", err, k3scfg.clusterName)
+	}
+
+	// terminate every instance that still exists in a single call
+	instances, err := describeInstancesByID(client, state.instanceIDs())
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for id, v := range instances {
+		// 48 - terminated
+		if *v.State.Code != 48 {
+			ids = append(ids, id)
+		}
+	}
+	if err := terminateInstances(client, ids); err != nil {
+		return err
+	}
+
+	// security groups can't be deleted while an instance still uses them
+	if err := waitTerminated(client, ids); err != nil {
+		return fmt.Errorf("%v, run 'k3sdeploy delete %s' to retry", err, k3scfg.clusterName)
+	}
+	if db := state.Datastore; db != nil {
+		if err := waitDatastoresDeleted(dbClient, idsDB, []string{db.SubnetGroup}); err != nil {
+			return fmt.Errorf("%v, run 'k3sdeploy delete %s' to retry", err, k3scfg.clusterName)
+		}
+		state.update(func(s *clusterState) {
+			s.Datastore = nil
+		})
+	}
+
+	names := map[string]string{}
+	for _, v := range state.SecurityGroups {
+		names[v.ID] = v.Name
+	}
+	failed := deleteSGs(client, state.securityGroupIDs(), names)
+
+	gone := map[string]bool{}
+	for _, id := range append(state.instanceIDs(), state.securityGroupIDs()...) {
+		gone[id] = true
+	}
+	for _, id := range failed {
+		gone[id] = false
+	}
+
+	if len(failed) > 0 {
+		state.update(func(s *clusterState) {
+			var kept []stateInstance
+			for _, v := range s.Instances {
+				if !gone[v.ID] {
+					kept = append(kept, v)
+				}
+			}
+			s.Instances = kept
+
+			var keptSG []stateSecurityGroup
+			for _, v := range s.SecurityGroups {
+				if !gone[v.ID] {
+					keptSG = append(keptSG, v)
+				}
+			}
+			s.SecurityGroups = keptSG
+		})
+		return fmt.Errorf("failed to remove %q, run 'k3sdeploy delete %s' to retry", strings.Join(failed, ","), k3scfg.clusterName)
+	}
+
+	removeClusterDir(k3scfg.clusterName)
+	log.Printf("Rolled back cluster %q.\n", k3scfg.clusterName)
+	return nil
+}
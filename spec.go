@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// specVersion is the only cluster spec file version understood by this release
+const specVersion = "v1"
+
+// defaultInstanceTypes are used by architecture for any role without an instance type set
+var defaultInstanceTypes = map[string]string{
+	"x86_64": "t2.micro",
+	"arm64":  "t4g.micro",
+}
+
+// amiID matches an EC2 AMI id
+var amiID = regexp.MustCompile(`^ami-[0-9a-f]{8}([0-9a-f]{9})?$`)
+
+// rdsIdentifier matches the RDS instance identifiers allowed by AWS
+var rdsIdentifier = regexp.MustCompile(`^[a-z]([a-z0-9]|-[a-z0-9]){0,62}$`)
+
+// elbClusterName matches the cluster names usable in load balancer and target group names
+var elbClusterName = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+
+// defaultReadyTimeout is how long create waits on every node to be Ready when not set
+const defaultReadyTimeout = "10m"
+
+// clusterSpec is the declarative cluster definition read from a spec file, e.g.
+//
+//	version: v1
+//	name: my-k3s-cluster
+//	region: us-east-1
+//	count: 3
+//	servers: 1
+//	key: /path/to/ec2/private/key.pem
+//	subnets: [subnet-12345, subnet-45567]
+//	instanceTypes:
+//	  bastion: t2.micro
+//	  server: t3.medium
+//	  worker: t3.medium
+//	workerGroups:
+//	  - name: general
+//	    count: 2
+//	  - name: legacy
+//	    count: 1
+//	    arch: x86_64
+//	    instanceType: t3.medium
+//	rootVolumes:
+//	  worker:
+//	    size: 50
+//	    type: gp3
+//	spotWorkers: true
+//	spotMaxPrice: "0.02"
+//	spotFallback: true
+//	k3sVersion: v1.21.3+k3s1
+//	image: ubuntu
+//	arch: arm64
+//	parallelism: 5
+//	readyTimeout: 10m
+//	loadBalancer: true
+//	datastore: postgres
+//	tags:
+//	  team: platform
+type clusterSpec struct {
+	Version       string            `yaml:"version"`
+	Name          string            `yaml:"name"`
+	Region        string            `yaml:"region"`
+	Count         int32             `yaml:"count"`
+	Servers       int32             `yaml:"servers"`
+	Key           string            `yaml:"key"`
+	Subnets       []string          `yaml:"subnets"`
+	InstanceTypes instanceTypesSpec `yaml:"instanceTypes"`
+	WorkerGroups  []workerGroupSpec `yaml:"workerGroups"`
+	RootVolumes   rootVolumesSpec   `yaml:"rootVolumes"`
+	SpotWorkers   bool              `yaml:"spotWorkers"`
+	SpotMaxPrice  string            `yaml:"spotMaxPrice"`
+	SpotFallback  bool              `yaml:"spotFallback"`
+	K3sVersion    string            `yaml:"k3sVersion"`
+	Image         string            `yaml:"image"`
+	AMI           string            `yaml:"ami"`
+	SSHUser       string            `yaml:"sshUser"`
+	Arch          string            `yaml:"arch"`
+	Parallelism   int               `yaml:"parallelism"`
+	ReadyTimeout  string            `yaml:"readyTimeout"`
+	LoadBalancer  bool              `yaml:"loadBalancer"`
+	Datastore     string            `yaml:"datastore"`
+	Tags          map[string]string `yaml:"tags"`
+}
+
+// instanceTypesSpec is the EC2 instance type for each node role
+type instanceTypesSpec struct {
+	Bastion string `yaml:"bastion"`
+	Server  string `yaml:"server"`
+	Worker  string `yaml:"worker"`
+}
+
+// rootVolumesSpec is the root EBS volume for each node role
+type rootVolumesSpec struct {
+	Bastion rootVolumeSpec `yaml:"bastion"`
+	Server  rootVolumeSpec `yaml:"server"`
+	Worker  rootVolumeSpec `yaml:"worker"`
+}
+
+// rootVolumeSpec is a root EBS volume, encrypted with the default EBS key unless disabled or
+// given a KMS key
+type rootVolumeSpec struct {
+	Size       int32  `yaml:"size"`
+	Type       string `yaml:"type"`
+	IOPS       int32  `yaml:"iops"`
+	Throughput int32  `yaml:"throughput"`
+	Encrypted  *bool  `yaml:"encrypted"`
+	KMSKeyID   string `yaml:"kmsKeyId"`
+}
+
+// default root volume settings, the bastion only needs the AMI minimum
+const (
+	defaultRootVolumeType    = "gp3"
+	defaultRootVolumeSize    = 20
+	defaultBastionVolumeSize = 8
+)
+
+// setDefaults fills in the optional fields of the volume left empty
+func (v *rootVolumeSpec) setDefaults(size int32) {
+	if v.Size == 0 {
+		v.Size = size
+	}
+	if v.Type == "" {
+		v.Type = defaultRootVolumeType
+	}
+	if v.Encrypted == nil {
+		encrypted := true
+		v.Encrypted = &encrypted
+	}
+}
+
+// validate returns an error naming the first invalid setting of the volume at spec field
+func (v *rootVolumeSpec) validate(field string) error {
+	if v.Size < 1 || v.Size > 16384 {
+		return fmt.Errorf("spec field %q must be between 1 and 16384 GiB, got %d", field+".size", v.Size)
+	}
+
+	switch v.Type {
+	case "gp2":
+		if v.IOPS != 0 {
+			return fmt.Errorf("spec field %q can't be set for %q volumes", field+".iops", v.Type)
+		}
+	case "gp3":
+		if v.IOPS != 0 && (v.IOPS < 3000 || v.IOPS > 16000) {
+			return fmt.Errorf("spec field %q must be between 3000 and 16000 for %q volumes, got %d", field+".iops", v.Type, v.IOPS)
+		}
+		if v.Throughput != 0 && (v.Throughput < 125 || v.Throughput > 1000) {
+			return fmt.Errorf("spec field %q must be between 125 and 1000 MiB/s, got %d", field+".throughput", v.Throughput)
+		}
+	case "io1", "io2":
+		if v.IOPS < 100 || v.IOPS > 64000 {
+			return fmt.Errorf("spec field %q must be between 100 and 64000 for %q volumes, got %d", field+".iops", v.Type, v.IOPS)
+		}
+	default:
+		return fmt.Errorf("spec field %q: %q must be one of gp2, gp3, io1 or io2", field+".type", v.Type)
+	}
+	if v.Throughput != 0 && v.Type != "gp3" {
+		return fmt.Errorf("spec field %q can only be set for %q volumes", field+".throughput", "gp3")
+	}
+	if v.KMSKeyID != "" && !*v.Encrypted {
+		return fmt.Errorf("spec field %q requires %q", field+".kmsKeyId", field+".encrypted")
+	}
+	return nil
+}
+
+// toRootVolume converts a validated volume spec to the volume of the config object
+func (v *rootVolumeSpec) toRootVolume() rootVolume {
+	return rootVolume{
+		size:       v.Size,
+		volumeType: v.Type,
+		iops:       v.IOPS,
+		throughput: v.Throughput,
+		encrypted:  *v.Encrypted,
+		kmsKeyID:   v.KMSKeyID,
+	}
+}
+
+// workerGroupSpec is a named set of workers with their own architecture, defaulting to arch,
+// and instance type, defaulting to instanceTypes.worker for the same architecture
+type workerGroupSpec struct {
+	Name         string `yaml:"name"`
+	Count        int32  `yaml:"count"`
+	Arch         string `yaml:"arch"`
+	InstanceType string `yaml:"instanceType"`
+}
+
+// workerGroupName matches the worker group names usable as a k3s node label value
+var workerGroupName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// specField is a spec field that can be overridden from an ENV variable and a create flag
+type specField struct {
+	field string
+	env   string
+	flag  string
+	usage string
+	set   func(s *clusterSpec, v string) error
+}
+
+// boolSpecFields are the spec fields set to true or false, their flags can be given bare
+var boolSpecFields = map[string]bool{
+	"spotWorkers":  true,
+	"spotFallback": true,
+	"loadBalancer": true,
+}
+
+// specBoolFlag is the flag of a true or false spec field, so -spot-workers sets it to true
+// and -spot-workers=false to false
+type specBoolFlag struct {
+	value string
+}
+
+// String implements flag.Value
+func (f *specBoolFlag) String() string {
+	return f.value
+}
+
+// Set implements flag.Value
+func (f *specBoolFlag) Set(v string) error {
+	if _, err := strconv.ParseBool(v); err != nil {
+		return fmt.Errorf("%q is not true or false", v)
+	}
+	f.value = v
+	return nil
+}
+
+// IsBoolFlag tells the flag package the value is optional
+func (f *specBoolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// specFields lists the overridable spec fields in the order their flags are defined
+var specFields = []specField{
+	{"count", "K3S_COUNT", "c", "The number of k3s cluster instances.", func(s *clusterSpec, v string) error {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+		s.Count = int32(n)
+		return nil
+	}},
+	{"servers", "K3S_SERVERS", "servers", "The number of k3s servers, odd, more than one runs embedded etcd.", func(s *clusterSpec, v string) error {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+		s.Servers = int32(n)
+		return nil
+	}},
+	{"name", "K3S_NAME", "n", "The name of the k3s cluster.", func(s *clusterSpec, v string) error {
+		s.Name = v
+		return nil
+	}},
+	{"key", "K3S_KEY", "k", "The full path to the ssh key to use when provisioning instances.", func(s *clusterSpec, v string) error {
+		s.Key = v
+		return nil
+	}},
+	{"subnets", "K3S_SUBNETS", "s", "Comma separated list of subnets-ids to place instances in.", func(s *clusterSpec, v string) error {
+		s.Subnets = splitList(v)
+		return nil
+	}},
+	{"region", "K3S_REGION", "region", "The AWS region to deploy the cluster in.", func(s *clusterSpec, v string) error {
+		s.Region = v
+		return nil
+	}},
+	{"k3sVersion", "K3S_VERSION", "k3s-version", "The k3s version to install, defaults to the latest stable release.", func(s *clusterSpec, v string) error {
+		s.K3sVersion = v
+		return nil
+	}},
+	{"image", "K3S_IMAGE", "image", "The OS image of every instance, al2, al2023, ubuntu or debian.", func(s *clusterSpec, v string) error {
+		s.Image = v
+		return nil
+	}},
+	{"ami", "K3S_AMI", "ami", "The AMI id of every instance instead of the latest release of the image, which must still name its OS.", func(s *clusterSpec, v string) error {
+		s.AMI = v
+		return nil
+	}},
+	{"sshUser", "K3S_SSH_USER", "ssh-user", "The ssh login user of the instances, defaults to the one of the image.", func(s *clusterSpec, v string) error {
+		s.SSHUser = v
+		return nil
+	}},
+	{"arch", "K3S_ARCH", "arch", "The CPU architecture of the instances, x86_64 or arm64, worker groups can set their own.", func(s *clusterSpec, v string) error {
+		s.Arch = v
+		return nil
+	}},
+	{"instanceTypes.bastion", "K3S_BASTION_TYPE", "bastion-type", "The EC2 instance type of the bastion.", func(s *clusterSpec, v string) error {
+		s.InstanceTypes.Bastion = v
+		return nil
+	}},
+	{"instanceTypes.server", "K3S_SERVER_TYPE", "server-type", "The EC2 instance type of the k3s server.", func(s *clusterSpec, v string) error {
+		s.InstanceTypes.Server = v
+		return nil
+	}},
+	{"instanceTypes.worker", "K3S_WORKER_TYPE", "worker-type", "The EC2 instance type of the k3s workers.", func(s *clusterSpec, v string) error {
+		s.InstanceTypes.Worker = v
+		return nil
+	}},
+	{"spotWorkers", "K3S_SPOT_WORKERS", "spot-workers", "Launch the workers as spot instances, true or false.", func(s *clusterSpec, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		s.SpotWorkers = b
+		return nil
+	}},
+	{"spotMaxPrice", "K3S_SPOT_MAX_PRICE", "spot-max-price", "The max hourly USD price of a spot worker, defaults to the on-demand price.", func(s *clusterSpec, v string) error {
+		s.SpotMaxPrice = v
+		return nil
+	}},
+	{"spotFallback", "K3S_SPOT_FALLBACK", "spot-fallback", "Launch a spot worker on-demand when there is no spot capacity, true or false.", func(s *clusterSpec, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		s.SpotFallback = b
+		return nil
+	}},
+	{"rootVolumes.bastion.size", "K3S_BASTION_VOLUME_SIZE", "bastion-volume-size", "The root volume size in GiB of the bastion.", func(s *clusterSpec, v string) error {
+		return setVolumeSize(&s.RootVolumes.Bastion, v)
+	}},
+	{"rootVolumes.server.size", "K3S_SERVER_VOLUME_SIZE", "server-volume-size", "The root volume size in GiB of the k3s servers.", func(s *clusterSpec, v string) error {
+		return setVolumeSize(&s.RootVolumes.Server, v)
+	}},
+	{"rootVolumes.worker.size", "K3S_WORKER_VOLUME_SIZE", "worker-volume-size", "The root volume size in GiB of the k3s workers.", func(s *clusterSpec, v string) error {
+		return setVolumeSize(&s.RootVolumes.Worker, v)
+	}},
+	{"parallelism", "K3S_PARALLELISM", "parallelism", "The number of workers launched at the same time.", func(s *clusterSpec, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+		s.Parallelism = n
+		return nil
+	}},
+	{"readyTimeout", "K3S_READY_TIMEOUT", "ready-timeout", "How long to wait on every node to be Ready, e.g. 10m.", func(s *clusterSpec, v string) error {
+		s.ReadyTimeout = v
+		return nil
+	}},
+	{"loadBalancer", "K3S_LOAD_BALANCER", "load-balancer", "Put an internal network load balancer in front of the k3s API servers, true or false.", func(s *clusterSpec, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		s.LoadBalancer = b
+		return nil
+	}},
+	{"datastore", "K3S_DATASTORE", "datastore", "Keep the k3s state in a new RDS instance, postgres or mysql, instead of on the servers.", func(s *clusterSpec, v string) error {
+		s.Datastore = v
+		return nil
+	}},
+	{"tags", "K3S_TAGS", "t", "Comma separated list of key=value tags added to every resource.", func(s *clusterSpec, v string) error {
+		if s.Tags == nil {
+			s.Tags = map[string]string{}
+		}
+		for _, kv := range splitList(v) {
+			i := strings.Index(kv, "=")
+			if i < 1 {
+				return fmt.Errorf("%q is not a key=value pair", kv)
+			}
+			s.Tags[kv[:i]] = kv[i+1:]
+		}
+		return nil
+	}},
+}
+
+// setVolumeSize sets the size of the root volume v from a flag or ENV value
+func setVolumeSize(v *rootVolumeSpec, size string) error {
+	n, err := strconv.ParseInt(size, 10, 32)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", size)
+	}
+	v.Size = int32(n)
+	return nil
+}
+
+// splitList splits a comma separated list dropping empty items
+func splitList(v string) (items []string) {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// loadSpec reads the cluster spec file at path, rejecting unknown fields
+func loadSpec(path string) (*clusterSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec file, %v", err)
+	}
+
+	s := &clusterSpec{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("failed to parse spec file %q, %v", path, err)
+	}
+
+	if s.Version == "" {
+		return nil, fmt.Errorf("spec field %q is required", "version")
+	}
+	if s.Version != specVersion {
+		return nil, fmt.Errorf("spec field %q: unsupported version %q, expected %q", "version", s.Version, specVersion)
+	}
+
+	return s, nil
+}
+
+// defineSpecFlags adds a flag for every overridable spec field to fs
+func defineSpecFlags(fs *flag.FlagSet) {
+	for _, v := range specFields {
+		usage := fmt.Sprintf("%s (ENV %s)", v.usage, v.env)
+		if boolSpecFields[v.field] {
+			fs.Var(&specBoolFlag{}, v.flag, usage)
+			continue
+		}
+		fs.String(v.flag, "", usage)
+	}
+}
+
+// applyEnv overrides the spec with every set ENV variable
+func (s *clusterSpec) applyEnv() error {
+	for _, v := range specFields {
+		val, ok := os.LookupEnv(v.env)
+		if !ok {
+			continue
+		}
+		if err := v.set(s, val); err != nil {
+			return fmt.Errorf("spec field %q from ENV %q: %v", v.field, v.env, err)
+		}
+	}
+	return nil
+}
+
+// applyFlags overrides the spec with every flag set on the command line
+func (s *clusterSpec) applyFlags(fs *flag.FlagSet) (err error) {
+	fs.Visit(func(f *flag.Flag) {
+		for _, v := range specFields {
+			if err != nil || v.flag != f.Name {
+				continue
+			}
+			if e := v.set(s, f.Value.String()); e != nil {
+				err = fmt.Errorf("spec field %q from flag %q: %v", v.field, "-"+v.flag, e)
+			}
+		}
+	})
+	return err
+}
+
+// setDefaults fills in the optional fields left empty
+func (s *clusterSpec) setDefaults() {
+	if s.Servers == 0 {
+		s.Servers = 1
+	}
+	if s.Parallelism == 0 {
+		s.Parallelism = defaultParallelism
+	}
+	if s.ReadyTimeout == "" {
+		s.ReadyTimeout = defaultReadyTimeout
+	}
+	if s.Image == "" {
+		s.Image = defaultImage
+	}
+	if s.SSHUser == "" {
+		s.SSHUser = osImages[s.Image].sshUser
+	}
+	if s.Arch == "" {
+		s.Arch = defaultArch
+	}
+	if s.InstanceTypes.Bastion == "" {
+		s.InstanceTypes.Bastion = defaultInstanceTypes[s.Arch]
+	}
+	if s.InstanceTypes.Server == "" {
+		s.InstanceTypes.Server = defaultInstanceTypes[s.Arch]
+	}
+	if s.InstanceTypes.Worker == "" {
+		s.InstanceTypes.Worker = defaultInstanceTypes[s.Arch]
+	}
+	s.RootVolumes.Bastion.setDefaults(defaultBastionVolumeSize)
+	s.RootVolumes.Server.setDefaults(defaultRootVolumeSize)
+	s.RootVolumes.Worker.setDefaults(defaultRootVolumeSize)
+	for i := range s.WorkerGroups {
+		g := &s.WorkerGroups[i]
+		if g.Arch == "" {
+			g.Arch = s.Arch
+		}
+		// instanceTypes.worker is of the cluster architecture
+		if g.InstanceType == "" && g.Arch == s.Arch {
+			g.InstanceType = s.InstanceTypes.Worker
+		}
+		if g.InstanceType == "" {
+			g.InstanceType = defaultInstanceTypes[g.Arch]
+		}
+	}
+	// with worker groups the count follows from the servers and the groups
+	if s.Count == 0 && len(s.WorkerGroups) > 0 {
+		s.Count = s.Servers + s.workerGroupsCount()
+	}
+}
+
+// workerGroupsCount returns the number of workers in every worker group
+func (s *clusterSpec) workerGroupsCount() (n int32) {
+	for _, v := range s.WorkerGroups {
+		n += v.Count
+	}
+	return n
+}
+
+// validate returns an error naming the first invalid spec field
+func (s *clusterSpec) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("spec field %q is required", "name")
+	}
+	if s.Count < 1 {
+		return fmt.Errorf("spec field %q must be at least 1, got %d", "count", s.Count)
+	}
+	if s.Servers < 1 || s.Servers%2 == 0 {
+		return fmt.Errorf("spec field %q must be an odd number for etcd quorum, got %d", "servers", s.Servers)
+	}
+	if s.Servers > s.Count {
+		return fmt.Errorf("spec field %q: %d servers is more than the %d instances of %q", "servers", s.Servers, s.Count, "count")
+	}
+	if _, ok := defaultInstanceTypes[s.Arch]; !ok {
+		return fmt.Errorf("spec field %q: %q must be %q or %q", "arch", s.Arch, "x86_64", "arm64")
+	}
+	names := map[string]bool{}
+	for i, v := range s.WorkerGroups {
+		if !workerGroupName.MatchString(v.Name) {
+			return fmt.Errorf("spec field %q: item %d name %q must be lower case letters, digits and hyphens", "workerGroups", i, v.Name)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("spec field %q: item %d name %q is used twice", "workerGroups", i, v.Name)
+		}
+		names[v.Name] = true
+		if v.Count < 1 {
+			return fmt.Errorf("spec field %q: item %d %q count must be at least 1, got %d", "workerGroups", i, v.Name, v.Count)
+		}
+		if _, ok := defaultInstanceTypes[v.Arch]; !ok {
+			return fmt.Errorf("spec field %q: item %d %q arch %q must be %q or %q", "workerGroups", i, v.Name, v.Arch, "x86_64", "arm64")
+		}
+		// a set AMI has a single architecture
+		if s.AMI != "" && v.Arch != s.Arch {
+			return fmt.Errorf("spec field %q: item %d %q arch %q can't differ from %q with %q set", "workerGroups", i, v.Name, v.Arch, "arch", "ami")
+		}
+	}
+	if len(s.WorkerGroups) > 0 && s.Count != s.Servers+s.workerGroupsCount() {
+		return fmt.Errorf("spec field %q: %d must be the %d servers plus the %d workers of %q", "count", s.Count, s.Servers, s.workerGroupsCount(), "workerGroups")
+	}
+	if s.Key == "" {
+		return fmt.Errorf("spec field %q is required", "key")
+	}
+	if len(s.Subnets) == 0 {
+		return fmt.Errorf("spec field %q requires at least one subnet id", "subnets")
+	}
+	for i, v := range s.Subnets {
+		if !strings.HasPrefix(v, "subnet-") {
+			return fmt.Errorf("spec field %q: item %d %q is not a subnet id", "subnets", i, v)
+		}
+	}
+	if _, ok := osImages[s.Image]; !ok {
+		return fmt.Errorf("spec field %q: %q must be one of %s", "image", s.Image, imageNames())
+	}
+	if s.AMI != "" && !amiID.MatchString(s.AMI) {
+		return fmt.Errorf("spec field %q: %q is not an AMI id", "ami", s.AMI)
+	}
+	if s.SSHUser == "" {
+		return fmt.Errorf("spec field %q is required", "sshUser")
+	}
+	if err := s.RootVolumes.Bastion.validate("rootVolumes.bastion"); err != nil {
+		return err
+	}
+	if err := s.RootVolumes.Server.validate("rootVolumes.server"); err != nil {
+		return err
+	}
+	if err := s.RootVolumes.Worker.validate("rootVolumes.worker"); err != nil {
+		return err
+	}
+	if s.SpotMaxPrice != "" {
+		if p, err := strconv.ParseFloat(s.SpotMaxPrice, 64); err != nil || p <= 0 {
+			return fmt.Errorf("spec field %q: %q must be a positive USD price like 0.02", "spotMaxPrice", s.SpotMaxPrice)
+		}
+	}
+	if !s.SpotWorkers && (s.SpotMaxPrice != "" || s.SpotFallback) {
+		return fmt.Errorf("spec fields %q and %q require %q", "spotMaxPrice", "spotFallback", "spotWorkers")
+	}
+	if s.Parallelism < 1 {
+		return fmt.Errorf("spec field %q must be at least 1, got %d", "parallelism", s.Parallelism)
+	}
+	if d, err := time.ParseDuration(s.ReadyTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("spec field %q: %q must be a positive duration like 10m", "readyTimeout", s.ReadyTimeout)
+	}
+	switch s.Datastore {
+	case "", datastorePostgres, datastoreMySQL:
+	default:
+		return fmt.Errorf("spec field %q: %q must be %q or %q", "datastore", s.Datastore, datastorePostgres, datastoreMySQL)
+	}
+	// the cluster name is part of the RDS identifier
+	if s.Datastore != "" && !rdsIdentifier.MatchString(datastoreName(s.Name)) {
+		return fmt.Errorf("spec field %q: %q must start with a letter, only have letters, digits and single hyphens and be at most 53 characters with a datastore", "name", s.Name)
+	}
+	// the cluster name is part of the load balancer and target group names
+	if s.LoadBalancer && (!elbClusterName.MatchString(s.Name) || strings.HasPrefix(strings.ToLower(s.Name), "internal-")) {
+		return fmt.Errorf("spec field %q: %q must only have letters, digits and hyphens, not start or end with a hyphen and not start with %q with a load balancer", "name", s.Name, "internal-")
+	}
+	if s.K3sVersion != "" && !strings.HasPrefix(s.K3sVersion, "v") {
+		return fmt.Errorf("spec field %q: %q must look like v1.21.3+k3s1", "k3sVersion", s.K3sVersion)
+	}
+
+	// sort so the reported key is stable between runs
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch k {
+		case tagName, tagK3sdeploycluster, tagK3sdeploy, tagSource, tagK3sdeployImage, tagK3sdeployAMI:
+			return fmt.Errorf("spec field %q: tag key %q is reserved for k3sdeploy", "tags", k)
+		}
+		if strings.HasPrefix(strings.ToLower(k), "aws:") {
+			return fmt.Errorf("spec field %q: tag key %q uses the reserved aws: prefix", "tags", k)
+		}
+	}
+
+	return nil
+}
+
+// toCfg converts a validated spec to the config object for service
+func (s *clusterSpec) toCfg() *cfg {
+	readyTimeout, _ := time.ParseDuration(s.ReadyTimeout)
+
+	// without worker groups every worker is in one unnamed group
+	groups := []workerGroup{{count: s.Count - s.Servers, arch: s.Arch, instanceType: s.InstanceTypes.Worker}}
+	if len(s.WorkerGroups) > 0 {
+		groups = groups[:0]
+		for _, v := range s.WorkerGroups {
+			groups = append(groups, workerGroup{name: v.Name, count: v.Count, arch: v.Arch, instanceType: v.InstanceType})
+		}
+	}
+
+	return &cfg{
+		count:        s.Count,
+		servers:      s.Servers,
+		clusterName:  s.Name,
+		key:          keyName(s.Key),
+		keyPath:      s.Key,
+		subnets:      s.Subnets,
+		region:       s.Region,
+		k3sVersion:   s.K3sVersion,
+		tags:         s.Tags,
+		bastionType:  s.InstanceTypes.Bastion,
+		serverType:   s.InstanceTypes.Server,
+		workerGroups: groups,
+		spotWorkers:  s.SpotWorkers,
+		spotMaxPrice: s.SpotMaxPrice,
+		spotFallback: s.SpotFallback,
+		image:        s.Image,
+		ami:          s.AMI,
+		sshUser:      s.SSHUser,
+		arch:         s.Arch,
+		rootVolumes: map[string]rootVolume{
+			"bastion": s.RootVolumes.Bastion.toRootVolume(),
+			"server":  s.RootVolumes.Server.toRootVolume(),
+			"worker":  s.RootVolumes.Worker.toRootVolume(),
+		},
+		parallelism:  s.Parallelism,
+		readyTimeout: readyTimeout,
+		loadBalancer: s.LoadBalancer,
+		datastore:    s.Datastore,
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSpec writes a spec file with body and returns its path
+func writeSpec(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cluster.yaml")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newSpecFlagSet returns a silent create flag set with every spec field flag
+func newSpecFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	defineSpecFlags(fs)
+	return fs
+}
+
+func TestSpecPrecedence(t *testing.T) {
+	tests := []struct {
+		field    string
+		file     string
+		fileWant string
+		env      string
+		flag     string
+		get      func(s *clusterSpec) string
+	}{
+		{"count", "count: 3", "3", "4", "5", func(s *clusterSpec) string { return fmt.Sprint(s.Count) }},
+		{"servers", "servers: 1", "1", "3", "5", func(s *clusterSpec) string { return fmt.Sprint(s.Servers) }},
+		{"name", "name: file", "file", "env", "flag", func(s *clusterSpec) string { return s.Name }},
+		{"key", "key: /file.pem", "/file.pem", "/env.pem", "/flag.pem", func(s *clusterSpec) string { return s.Key }},
+		{"subnets", "subnets: [subnet-1, subnet-2]", "subnet-1,subnet-2", "subnet-3,subnet-4", "subnet-5", func(s *clusterSpec) string { return strings.Join(s.Subnets, ",") }},
+		{"region", "region: us-east-1", "us-east-1", "us-west-2", "eu-west-1", func(s *clusterSpec) string { return s.Region }},
+		{"k3sVersion", "k3sVersion: v1.20.9+k3s1", "v1.20.9+k3s1", "v1.21.3+k3s1", "v1.22.2+k3s1", func(s *clusterSpec) string { return s.K3sVersion }},
+		{"image", "image: al2", "al2", "ubuntu", "debian", func(s *clusterSpec) string { return s.Image }},
+		{"ami", "ami: ami-11111111", "ami-11111111", "ami-22222222", "ami-33333333", func(s *clusterSpec) string { return s.AMI }},
+		{"sshUser", "sshUser: file", "file", "env", "flag", func(s *clusterSpec) string { return s.SSHUser }},
+		{"arch", "arch: x86_64", "x86_64", "arm64", "x86_64", func(s *clusterSpec) string { return s.Arch }},
+		{"instanceTypes.bastion", "instanceTypes: {bastion: t3.nano}", "t3.nano", "t3.micro", "t3.small", func(s *clusterSpec) string { return s.InstanceTypes.Bastion }},
+		{"instanceTypes.server", "instanceTypes: {server: t3.nano}", "t3.nano", "t3.micro", "t3.small", func(s *clusterSpec) string { return s.InstanceTypes.Server }},
+		{"instanceTypes.worker", "instanceTypes: {worker: t3.nano}", "t3.nano", "t3.micro", "t3.small", func(s *clusterSpec) string { return s.InstanceTypes.Worker }},
+		{"spotWorkers", "spotWorkers: true", "true", "false", "true", func(s *clusterSpec) string { return fmt.Sprint(s.SpotWorkers) }},
+		{"spotMaxPrice", "spotMaxPrice: \"0.01\"", "0.01", "0.02", "0.03", func(s *clusterSpec) string { return s.SpotMaxPrice }},
+		{"spotFallback", "spotFallback: false", "false", "true", "false", func(s *clusterSpec) string { return fmt.Sprint(s.SpotFallback) }},
+		{"rootVolumes.bastion.size", "rootVolumes: {bastion: {size: 8}}", "8", "10", "12", func(s *clusterSpec) string { return fmt.Sprint(s.RootVolumes.Bastion.Size) }},
+		{"rootVolumes.server.size", "rootVolumes: {server: {size: 20}}", "20", "30", "40", func(s *clusterSpec) string { return fmt.Sprint(s.RootVolumes.Server.Size) }},
+		{"rootVolumes.worker.size", "rootVolumes: {worker: {size: 20}}", "20", "30", "40", func(s *clusterSpec) string { return fmt.Sprint(s.RootVolumes.Worker.Size) }},
+		{"parallelism", "parallelism: 2", "2", "3", "4", func(s *clusterSpec) string { return fmt.Sprint(s.Parallelism) }},
+		{"readyTimeout", "readyTimeout: 5m", "5m", "10m", "15m", func(s *clusterSpec) string { return s.ReadyTimeout }},
+		{"loadBalancer", "loadBalancer: false", "false", "true", "false", func(s *clusterSpec) string { return fmt.Sprint(s.LoadBalancer) }},
+		{"datastore", "datastore: postgres", "postgres", "mysql", "postgres", func(s *clusterSpec) string { return s.Datastore }},
+		{"tags", "tags: {team: file}", "team=file", "team=env", "team=flag", func(s *clusterSpec) string { return "team=" + s.Tags["team"] }},
+	}
+
+	covered := map[string]bool{}
+	for _, tt := range tests {
+		covered[tt.field] = true
+	}
+	for _, v := range specFields {
+		if !covered[v.field] {
+			t.Errorf("spec field %q has no precedence test", v.field)
+		}
+	}
+
+	for _, tt := range tests {
+		var field specField
+		for _, v := range specFields {
+			if v.field == tt.field {
+				field = v
+			}
+		}
+
+		t.Run(tt.field, func(t *testing.T) {
+			// each stage adds a source over the ones before it
+			stages := []struct {
+				name string
+				env  bool
+				flag bool
+				want string
+			}{
+				{name: "file", want: tt.fileWant},
+				{name: "env over file", env: true, want: tt.env},
+				{name: "flag over env", env: true, flag: true, want: tt.flag},
+			}
+			path := writeSpec(t, "version: v1\n"+tt.file+"\n")
+			for _, st := range stages {
+				spec, err := loadSpec(path)
+				if err != nil {
+					t.Fatalf("%s: unexpected error, %v", st.name, err)
+				}
+				if st.env {
+					t.Setenv(field.env, tt.env)
+				}
+				if err := spec.applyEnv(); err != nil {
+					t.Fatalf("%s: unexpected error, %v", st.name, err)
+				}
+				fs := newSpecFlagSet()
+				if st.flag {
+					if err := fs.Parse([]string{"-" + field.flag + "=" + tt.flag}); err != nil {
+						t.Fatalf("%s: unexpected error, %v", st.name, err)
+					}
+				}
+				if err := spec.applyFlags(fs); err != nil {
+					t.Fatalf("%s: unexpected error, %v", st.name, err)
+				}
+
+				if got := tt.get(spec); got != st.want {
+					t.Errorf("%s: got %q, want %q", st.name, got, st.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSpecBoolFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      string
+		args     []string
+		wantCode int
+		wantOK   bool
+		wantArgs []string
+		want     bool
+	}{
+		{name: "bare flag", args: []string{"-load-balancer"}, wantOK: true, want: true},
+		{name: "flag set to true", args: []string{"-load-balancer=true"}, wantOK: true, want: true},
+		{name: "flag set to false over ENV", env: "true", args: []string{"-load-balancer=false"}, wantOK: true},
+		{name: "ENV without flag", env: "true", wantOK: true, want: true},
+		{name: "bare flag after a positional", args: []string{"extra", "-load-balancer"}, wantOK: true, wantArgs: []string{"extra"}, want: true},
+		{name: "value after the flag is left over", args: []string{"-load-balancer", "false"}, wantOK: true, wantArgs: []string{"false"}, want: true},
+		{name: "value not true or false", args: []string{"-load-balancer=maybe"}, wantCode: exitUsage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("K3S_LOAD_BALANCER", tt.env)
+			}
+			fs := newSpecFlagSet()
+			code, ok := parseFlags(fs, tt.args)
+			if code != tt.wantCode || ok != tt.wantOK {
+				t.Fatalf("got code %d ok %v, want code %d ok %v", code, ok, tt.wantCode, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := strings.Join(fs.Args(), " "); got != strings.Join(tt.wantArgs, " ") {
+				t.Errorf("got arguments %q, want %q", fs.Args(), tt.wantArgs)
+			}
+
+			spec := &clusterSpec{}
+			if err := spec.applyEnv(); err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+			if err := spec.applyFlags(fs); err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+			if spec.LoadBalancer != tt.want {
+				t.Errorf("got loadBalancer %v, want %v", spec.LoadBalancer, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "valid", body: "version: v1\nname: my-cluster\ncount: 3\n"},
+		{name: "unknown key", body: "version: v1\nname: my-cluster\ncuont: 3\n", wantErr: "cuont"},
+		{name: "unknown nested key", body: "version: v1\ninstanceTypes:\n  main: t3.small\n", wantErr: "main"},
+		{name: "wrong type", body: "version: v1\ncount: three\n", wantErr: "three"},
+		{name: "missing version", body: "name: my-cluster\n", wantErr: `"version"`},
+		{name: "unsupported version", body: "version: v2\n", wantErr: `"version"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadSpec(writeSpec(t, tt.body))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error, %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one naming %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// validSpec returns a spec with defaults that passes validate
+func validSpec() *clusterSpec {
+	s := &clusterSpec{
+		Name:    "my-cluster",
+		Count:   3,
+		Key:     "/path/to/key.pem",
+		Subnets: []string{"subnet-12345"},
+	}
+	s.setDefaults()
+	return s
+}
+
+func TestSpecValidate(t *testing.T) {
+	if err := validSpec().validate(); err != nil {
+		t.Fatalf("unexpected error for a valid spec, %v", err)
+	}
+	withLB := validSpec()
+	withLB.LoadBalancer = true
+	if err := withLB.validate(); err != nil {
+		t.Fatalf("unexpected error for a valid spec with a load balancer, %v", err)
+	}
+
+	off := false
+	tests := []struct {
+		field  string
+		modify func(s *clusterSpec)
+	}{
+		{"name", func(s *clusterSpec) { s.Name = "" }},
+		{"count", func(s *clusterSpec) { s.Count = 0 }},
+		{"servers", func(s *clusterSpec) { s.Servers = 2 }},
+		{"servers", func(s *clusterSpec) { s.Servers = 5 }},
+		{"arch", func(s *clusterSpec) { s.Arch = "sparc" }},
+		{"workerGroups", func(s *clusterSpec) { s.WorkerGroups = []workerGroupSpec{{Name: "General", Count: 2, Arch: s.Arch}} }},
+		{"workerGroups", func(s *clusterSpec) {
+			s.WorkerGroups = []workerGroupSpec{{Name: "a", Count: 1, Arch: s.Arch}, {Name: "a", Count: 1, Arch: s.Arch}}
+		}},
+		{"workerGroups", func(s *clusterSpec) { s.WorkerGroups = []workerGroupSpec{{Name: "a", Count: 0, Arch: s.Arch}} }},
+		{"workerGroups", func(s *clusterSpec) { s.WorkerGroups = []workerGroupSpec{{Name: "a", Count: 2, Arch: "sparc"}} }},
+		{"workerGroups", func(s *clusterSpec) {
+			s.AMI = "ami-12345678"
+			s.WorkerGroups = []workerGroupSpec{{Name: "a", Count: 2, Arch: "arm64"}}
+		}},
+		{"count", func(s *clusterSpec) { s.WorkerGroups = []workerGroupSpec{{Name: "a", Count: 1, Arch: s.Arch}} }},
+		{"key", func(s *clusterSpec) { s.Key = "" }},
+		{"subnets", func(s *clusterSpec) { s.Subnets = nil }},
+		{"subnets", func(s *clusterSpec) { s.Subnets = []string{"subnet-12345", "sg-12345"} }},
+		{"image", func(s *clusterSpec) { s.Image = "gentoo" }},
+		{"ami", func(s *clusterSpec) { s.AMI = "ami-xyz" }},
+		{"sshUser", func(s *clusterSpec) { s.SSHUser = "" }},
+		{"rootVolumes.bastion.size", func(s *clusterSpec) { s.RootVolumes.Bastion.Size = 0 }},
+		{"rootVolumes.server.type", func(s *clusterSpec) { s.RootVolumes.Server.Type = "st1" }},
+		{"rootVolumes.worker.iops", func(s *clusterSpec) { s.RootVolumes.Worker.IOPS = 100 }},
+		{"rootVolumes.worker.iops", func(s *clusterSpec) { s.RootVolumes.Worker.Type = "io2" }},
+		{"rootVolumes.worker.iops", func(s *clusterSpec) {
+			s.RootVolumes.Worker.Type = "gp2"
+			s.RootVolumes.Worker.IOPS = 3000
+		}},
+		{"rootVolumes.worker.throughput", func(s *clusterSpec) { s.RootVolumes.Worker.Throughput = 2000 }},
+		{"rootVolumes.worker.throughput", func(s *clusterSpec) {
+			s.RootVolumes.Worker.Type = "gp2"
+			s.RootVolumes.Worker.Throughput = 125
+		}},
+		{"rootVolumes.worker.kmsKeyId", func(s *clusterSpec) {
+			s.RootVolumes.Worker.Encrypted = &off
+			s.RootVolumes.Worker.KMSKeyID = "alias/k3s"
+		}},
+		{"spotMaxPrice", func(s *clusterSpec) {
+			s.SpotWorkers = true
+			s.SpotMaxPrice = "-1"
+		}},
+		{"spotFallback", func(s *clusterSpec) { s.SpotFallback = true }},
+		{"parallelism", func(s *clusterSpec) { s.Parallelism = 0 }},
+		{"readyTimeout", func(s *clusterSpec) { s.ReadyTimeout = "soon" }},
+		{"datastore", func(s *clusterSpec) { s.Datastore = "oracle" }},
+		{"name", func(s *clusterSpec) {
+			s.Datastore = datastorePostgres
+			s.Name = "9-lives"
+		}},
+		{"name", func(s *clusterSpec) {
+			s.LoadBalancer = true
+			s.Name = "my_cluster"
+		}},
+		{"name", func(s *clusterSpec) {
+			s.LoadBalancer = true
+			s.Name = "my.cluster"
+		}},
+		{"name", func(s *clusterSpec) {
+			s.LoadBalancer = true
+			s.Name = "-my-cluster"
+		}},
+		{"name", func(s *clusterSpec) {
+			s.LoadBalancer = true
+			s.Name = "my-cluster-"
+		}},
+		{"name", func(s *clusterSpec) {
+			s.LoadBalancer = true
+			s.Name = "internal-cluster"
+		}},
+		{"k3sVersion", func(s *clusterSpec) { s.K3sVersion = "1.21.3+k3s1" }},
+		{"tags", func(s *clusterSpec) { s.Tags = map[string]string{"team": "a", tagName: "b"} }},
+		{"tags", func(s *clusterSpec) { s.Tags = map[string]string{"AWS:owner": "a"} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			s := validSpec()
+			tt.modify(s)
+			err := s.validate()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("%q", tt.field)) {
+				t.Errorf("got error %v, want one naming %q", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOK   bool
+		wantArgs []string
+		wantYes  bool
+		wantKey  string
+	}{
+		{name: "flags before positionals", args: []string{"-yes", "my-cluster"}, wantOK: true, wantArgs: []string{"my-cluster"}, wantYes: true},
+		{name: "flags after positionals", args: []string{"my-cluster", "-yes"}, wantOK: true, wantArgs: []string{"my-cluster"}, wantYes: true},
+		{name: "flags between positionals", args: []string{"my-cluster", "-k", "key.pem", "server-1"}, wantOK: true,
+			wantArgs: []string{"my-cluster", "server-1"}, wantKey: "key.pem"},
+		{name: "everything after -- is positional", args: []string{"my-cluster", "--", "-yes"}, wantOK: true, wantArgs: []string{"my-cluster", "-yes"}},
+		{name: "no arguments", wantOK: true},
+		{name: "help", args: []string{"my-cluster", "-h"}, wantCode: exitOK},
+		{name: "unknown flag", args: []string{"my-cluster", "-nope"}, wantCode: exitUsage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			yes := fs.Bool("yes", false, "")
+			key := fs.String("k", "", "")
+
+			code, ok := parseFlags(fs, tt.args)
+			if code != tt.wantCode || ok != tt.wantOK {
+				t.Fatalf("got code %d ok %v, want code %d ok %v", code, ok, tt.wantCode, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := strings.Join(fs.Args(), " "); got != strings.Join(tt.wantArgs, " ") {
+				t.Errorf("got arguments %q, want %q", fs.Args(), tt.wantArgs)
+			}
+			if *yes != tt.wantYes || *key != tt.wantKey {
+				t.Errorf("got -yes %v -k %q, want -yes %v -k %q", *yes, *key, tt.wantYes, tt.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// spotFallbackErrors are the RunInstances error codes after which a spot worker is launched
+// on-demand instead when fallback is enabled
+var spotFallbackErrors = []string{
+	"InsufficientInstanceCapacity",
+	"SpotMaxPriceTooLow",
+	"MaxSpotInstanceCountExceeded",
+	"InsufficientCapacity",
+}
+
+// kubectlImage is the image of the interruption handler, it has sh, curl and a kubectl of
+// every Kubernetes minor version under a tag of that version, e.g. bitnami/kubectl:1.21
+const kubectlImage = "bitnami/kubectl"
+
+// k3sManifestsDir is where k3s auto deploys manifests from on a server
+const k3sManifestsDir = "/var/lib/rancher/k3s/server/manifests"
+
+// k3sMinorPlaceholder stands in for the k3s minor version in the handler image tag until the
+// main has installed k3s and knows it
+const k3sMinorPlaceholder = "K3S_MINOR_VERSION"
+
+// spotHandlerManifest returns the manifest auto deployed by k3s from the main running the
+// handler in image. On every worker it polls the instance metadata for the two-minute spot
+// interruption notice and then cordons and drains the node so its pods are rescheduled before
+// the instance is reclaimed. On-demand workers never get a notice.
+func spotHandlerManifest(image string) string {
+	return `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: k3sdeploy-spot-handler
+  namespace: kube-system
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: k3sdeploy-spot-handler
+rules:
+  - apiGroups: [""]
+    resources: ["nodes"]
+    verbs: ["get", "patch"]
+  - apiGroups: [""]
+    resources: ["pods"]
+    verbs: ["get", "list", "delete"]
+  - apiGroups: [""]
+    resources: ["pods/eviction"]
+    verbs: ["create"]
+  - apiGroups: ["apps"]
+    resources: ["daemonsets", "statefulsets", "replicasets"]
+    verbs: ["get"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: k3sdeploy-spot-handler
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: k3sdeploy-spot-handler
+subjects:
+  - kind: ServiceAccount
+    name: k3sdeploy-spot-handler
+    namespace: kube-system
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: k3sdeploy-spot-handler
+  namespace: kube-system
+spec:
+  selector:
+    matchLabels:
+      app: k3sdeploy-spot-handler
+  template:
+    metadata:
+      labels:
+        app: k3sdeploy-spot-handler
+    spec:
+      serviceAccountName: k3sdeploy-spot-handler
+      # the metadata service is only one hop away from the host network
+      hostNetwork: true
+      affinity:
+        nodeAffinity:
+          requiredDuringSchedulingIgnoredDuringExecution:
+            nodeSelectorTerms:
+              - matchExpressions:
+                  - key: node-role.kubernetes.io/control-plane
+                    operator: DoesNotExist
+                  - key: node-role.kubernetes.io/master
+                    operator: DoesNotExist
+      containers:
+        - name: handler
+          image: ` + image + `
+          env:
+            - name: NODE_NAME
+              valueFrom:
+                fieldRef:
+                  fieldPath: spec.nodeName
+          command: ["/bin/sh", "-c"]
+          args:
+            - |
+              while true; do
+                token=$(curl -s -X PUT -H "X-aws-ec2-metadata-token-ttl-seconds: 300" http://169.254.169.254/latest/api/token)
+                code=$(curl -s -o /dev/null -w "%{http_code}" -H "X-aws-ec2-metadata-token: $token" http://169.254.169.254/latest/meta-data/spot/instance-action)
+                if [ "$code" = "200" ]; then
+                  echo "spot interruption notice for $NODE_NAME, draining"
+                  kubectl cordon "$NODE_NAME"
+                  kubectl drain "$NODE_NAME" --ignore-daemonsets --delete-emptydir-data --force --grace-period=60 --timeout=100s
+                  sleep 300
+                fi
+                sleep 5
+              done
+          resources:
+            requests:
+              cpu: 10m
+              memory: 32Mi
+`
+}
+
+// spotHandlerDeploy returns the user data lines run on the main after the k3s install that
+// drop the interruption handler manifest where k3s auto deploys it from, with the kubectl
+// image tag of the minor version of the k3s installed
+func spotHandlerDeploy() string {
+	path := k3sManifestsDir + "/k3sdeploy-spot-handler.yaml"
+	return "mkdir -p " + k3sManifestsDir + "\n" +
+		"cat > " + path + " <<'EOF'\n" +
+		spotHandlerManifest(kubectlImage+":"+k3sMinorPlaceholder) +
+		"EOF\n" +
+		"k3s_minor=$(k3s --version | sed -n 's/^k3s version v\\([0-9]*\\.[0-9]*\\)\\..*/\\1/p')\n" +
+		"sed -i \"s/" + k3sMinorPlaceholder + "/$k3s_minor/\" " + path + "\n"
+}
+
+// spotMarketOptions returns the RunInstances market options of a one-time spot instance
+// capped at the spot max price, or at the on-demand price if none is set
+func spotMarketOptions(k3scfg *cfg) *types.InstanceMarketOptionsRequest {
+	options := &types.InstanceMarketOptionsRequest{
+		MarketType: types.MarketTypeSpot,
+		SpotOptions: &types.SpotMarketOptions{
+			SpotInstanceType:             types.SpotInstanceTypeOneTime,
+			InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorTerminate,
+		},
+	}
+	if k3scfg.spotMaxPrice != "" {
+		maxPrice := k3scfg.spotMaxPrice
+		options.SpotOptions.MaxPrice = &maxPrice
+	}
+	return options
+}
+
+// isSpotCapacityError reports whether err means no spot capacity is available at the max price
+func isSpotCapacityError(err error) bool {
+	for _, code := range spotFallbackErrors {
+		if isAPIError(err, code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifestObject is the part of a Kubernetes object checked by the spot handler tests
+type manifestObject struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Rules []struct {
+		Resources []string `yaml:"resources"`
+		Verbs     []string `yaml:"verbs"`
+	} `yaml:"rules"`
+	Subjects []struct {
+		Kind      string `yaml:"kind"`
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"subjects"`
+	Spec struct {
+		Template struct {
+			Spec struct {
+				ServiceAccountName string `yaml:"serviceAccountName"`
+				Containers         []struct {
+					Image string `yaml:"image"`
+				} `yaml:"containers"`
+			} `yaml:"spec"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+// parseManifest returns the objects of a multi document manifest by kind
+func parseManifest(t *testing.T, manifest string) map[string]manifestObject {
+	t.Helper()
+	objects := map[string]manifestObject{}
+	dec := yaml.NewDecoder(strings.NewReader(manifest))
+	for {
+		var obj manifestObject
+		err := dec.Decode(&obj)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to parse manifest, %v", err)
+		}
+		objects[obj.Kind] = obj
+	}
+	return objects
+}
+
+func TestSpotHandlerManifest(t *testing.T) {
+	objects := parseManifest(t, spotHandlerManifest(kubectlImage+":1.21"))
+
+	for _, kind := range []string{"ServiceAccount", "ClusterRole", "ClusterRoleBinding", "DaemonSet"} {
+		if _, ok := objects[kind]; !ok {
+			t.Fatalf("manifest has no %s", kind)
+		}
+	}
+	sa := objects["ServiceAccount"].Metadata
+
+	ds := objects["DaemonSet"]
+	if got := ds.Spec.Template.Spec.ServiceAccountName; got != sa.Name {
+		t.Errorf("DaemonSet runs as service account %q, want %q", got, sa.Name)
+	}
+	if containers := ds.Spec.Template.Spec.Containers; len(containers) != 1 || containers[0].Image != kubectlImage+":1.21" {
+		t.Errorf("DaemonSet containers %+v, want one running %q", containers, kubectlImage+":1.21")
+	}
+
+	bound := false
+	for _, v := range objects["ClusterRoleBinding"].Subjects {
+		if v.Kind == "ServiceAccount" && v.Name == sa.Name && v.Namespace == sa.Namespace {
+			bound = true
+		}
+	}
+	if !bound {
+		t.Errorf("ClusterRoleBinding doesn't bind service account %s/%s", sa.Namespace, sa.Name)
+	}
+
+	// cordon patches the node, drain evicts its pods
+	allowed := map[string]bool{}
+	for _, r := range objects["ClusterRole"].Rules {
+		for _, res := range r.Resources {
+			for _, verb := range r.Verbs {
+				allowed[res+"/"+verb] = true
+			}
+		}
+	}
+	for _, v := range []string{"nodes/patch", "pods/list", "pods/eviction/create"} {
+		if !allowed[v] {
+			t.Errorf("ClusterRole doesn't allow %s", v)
+		}
+	}
+}
+
+func TestSpotHandlerDeploy(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the user data with")
+	}
+	dir := t.TempDir()
+
+	// stand in for the k3s binary of the main, and write to dir instead of the manifests dir
+	k3s := "#!/bin/sh\necho 'k3s version v1.21.3+k3s1 (1d1f220f)'\necho 'go version go1.16.6'\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "k3s"), []byte(k3s), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := strings.Replace(spotHandlerDeploy(), k3sManifestsDir, dir, -1)
+
+	cmd := exec.Command("sh", "-e")
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("user data failed, %v, %s", err, stderr.String())
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, "k3sdeploy-spot-handler.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := spotHandlerManifest(kubectlImage + ":1.21"); string(manifest) != want {
+		t.Errorf("got manifest\n%s\nwant\n%s", manifest, want)
+	}
+}
@@ -1,154 +1,534 @@
 package main
 
 import (
-	"context"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
 )
 
-// sshExtractKubeConfig will shell in to the cluster main via bastion to
-// pull out the kubeconfig and replace 'default' with cluster main in local copy
-func sshExtractKubeConfig(ipBastion, ipClusterMain, clusterName string) []byte {
-	// shell command via ssh proxy to get kubeconfig
+// sshErrorKind classifies why an ssh operation failed
+type sshErrorKind int
+
+const (
+	// sshErrConnect is a failure to reach the host, e.g. connection refused or a timeout
+	sshErrConnect sshErrorKind = iota
+	// sshErrAuth is the host rejecting the key
+	sshErrAuth
+	// sshErrCommand is a remote command exiting non-zero or the session failing
+	sshErrCommand
+	// sshErrHostKey is the host presenting a key that is not pinned for it
+	sshErrHostKey
+)
+
+// String returns the name of the error kind
+func (k sshErrorKind) String() string {
+	switch k {
+	case sshErrConnect:
+		return "connection failed"
+	case sshErrAuth:
+		return "authentication failed"
+	case sshErrCommand:
+		return "command failed"
+	case sshErrHostKey:
+		return "host key verification failed"
+	}
+	return "unknown"
+}
+
+// sshError is returned by the ssh layer with the host and the kind of failure
+type sshError struct {
+	kind   sshErrorKind
+	host   string
+	stderr string
+	err    error
+}
+
+// Error implements error
+func (e *sshError) Error() string {
+	msg := fmt.Sprintf("ssh %s %s, %v", e.host, e.kind, e.err)
+	if e.stderr != "" {
+		msg += ": " + strings.TrimSpace(e.stderr)
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (e *sshError) Unwrap() error {
+	return e.err
+}
+
+// isSSHError reports whether err is an sshError of kind
+func isSSHError(err error, kind sshErrorKind) bool {
+	var e *sshError
+	return errors.As(err, &e) && e.kind == kind
+}
+
+// sshClientConfig holds what is needed to open ssh connections to the cluster nodes
+type sshClientConfig struct {
+	user            string
+	signer          ssh.Signer
+	hostKeyCallback ssh.HostKeyCallback
+	timeout         time.Duration
+}
+
+// newSSHClientConfig loads the private key at keyPath to log in as user, prompting for the
+// passphrase if the key is encrypted. Host keys are verified against the known_hosts file at knownHosts.
+func newSSHClientConfig(keyPath, user, knownHosts string) (*sshClientConfig, error) {
+	pem, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %q, %v", keyPath, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, fmt.Errorf("key file %q is encrypted and stdin is not a terminal to read the passphrase", keyPath)
+		}
+		fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", keyPath)
+		passphrase, perr := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if perr != nil {
+			return nil, fmt.Errorf("failed to read passphrase, %v", perr)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file %q, %v", keyPath, err)
+	}
+
+	return &sshClientConfig{
+		user:            user,
+		signer:          signer,
+		hostKeyCallback: knownHostsCallback(knownHosts),
+		timeout:         10 * time.Second,
+	}, nil
+}
+
+// handshake records how far an ssh handshake got. x/crypto flattens the errors of the
+// handshake into text, so the callbacks record the failures it would otherwise hide.
+type handshake struct {
+	hostKeyErr error
+	hostKeyOK  bool
+	authTried  bool
+}
+
+// clientConfig returns the x/crypto ssh client config, recording the handshake progress in h
+func (c *sshClientConfig) clientConfig(h *handshake) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: c.user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			h.authTried = true
+			return []ssh.Signer{c.signer}, nil
+		})},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := c.hostKeyCallback(hostname, remote, key)
+			h.hostKeyErr, h.hostKeyOK = err, err == nil
+			return err
+		},
+		Timeout: c.timeout,
+	}
+}
+
+// sshConn is an ssh connection to a node, tunnelled through the bastion for private nodes
+type sshConn struct {
+	addr    string
+	bastion *ssh.Client
+	client  *ssh.Client
+}
+
+// sshAddr returns host:22 unless host already has a port
+func sshAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "22")
+}
+
+// handshakeError classifies an error from the ssh handshake with host using what the
+// callbacks recorded in h
+func handshakeError(host string, err error, h *handshake) error {
+	var keyErr *knownhosts.KeyError
+	var opErr *net.OpError
+	switch {
+	case errors.As(h.hostKeyErr, &keyErr) || errors.Is(h.hostKeyErr, errHostKeyNotPinned):
+		return &sshError{kind: sshErrHostKey, host: host, err: h.hostKeyErr}
+	case h.hostKeyErr != nil:
+		// the known_hosts file couldn't be read, the key is still unverified
+		return &sshError{kind: sshErrHostKey, host: host, err: h.hostKeyErr}
+	case errors.As(err, &opErr):
+		return &sshError{kind: sshErrConnect, host: host, err: err}
+	case h.hostKeyOK && h.authTried:
+		return &sshError{kind: sshErrAuth, host: host, err: err}
+	}
+	return &sshError{kind: sshErrConnect, host: host, err: err}
+}
+
+// dialSSH connects to the bastion and, when target is set, jumps from the bastion to
+// target the same way ssh -J does
+func dialSSH(c *sshClientConfig, bastion, target string) (*sshConn, error) {
+	var bh handshake
+	bc, err := ssh.Dial("tcp", sshAddr(bastion), c.clientConfig(&bh))
+	if err != nil {
+		return nil, handshakeError(bastion, err, &bh)
+	}
+	if target == "" {
+		return &sshConn{addr: bastion, client: bc}, nil
+	}
+
+	// open a direct-tcpip channel from the bastion to the target
+	conn, err := bc.Dial("tcp", sshAddr(target))
+	if err != nil {
+		bc.Close()
+		return nil, &sshError{kind: sshErrConnect, host: target, err: err}
+	}
+
+	// the channel has no deadline support so bound the handshake with a timer
+	var th handshake
+	timer := time.AfterFunc(c.timeout, func() { conn.Close() })
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, sshAddr(target), c.clientConfig(&th))
+	timer.Stop()
+	if err != nil {
+		bc.Close()
+		return nil, handshakeError(target, err, &th)
+	}
+
+	return &sshConn{addr: target, bastion: bc, client: ssh.NewClient(ncc, chans, reqs)}, nil
+}
+
+// run executes cmd on the node and returns its stdout, the session is closed if it
+// runs longer than timeout
+func (s *sshConn) run(cmd string, timeout time.Duration) ([]byte, error) {
+	return s.runInput(cmd, nil, timeout)
+}
+
+// runInput executes cmd on the node with input on its stdin and returns its stdout, keeping
+// input off the command line where other users of the node could see it
+func (s *sshConn) runInput(cmd string, input []byte, timeout time.Duration) ([]byte, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, &sshError{kind: sshErrCommand, host: s.addr, err: err}
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	if input != nil {
+		session.Stdin = bytes.NewReader(input)
+	}
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	timer := time.AfterFunc(timeout, func() { session.Close() })
+	defer timer.Stop()
+
+	if err := session.Run(cmd); err != nil {
+		return nil, &sshError{kind: sshErrCommand, host: s.addr, stderr: stderr.String(), err: err}
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// shell opens an interactive login shell on the node attached to the local terminal
+func (s *sshConn) shell() error {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return &sshError{kind: sshErrCommand, host: s.addr, err: err}
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to set terminal to raw mode, %v", err)
+		}
+		defer term.Restore(fd, state)
+
+		w, h, err := term.GetSize(fd)
+		if err != nil {
+			w, h = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty(termType, h, w, modes); err != nil {
+			return &sshError{kind: sshErrCommand, host: s.addr, err: err}
+		}
+	}
+
+	if err := session.Shell(); err != nil {
+		return &sshError{kind: sshErrCommand, host: s.addr, err: err}
+	}
+	if err := session.Wait(); err != nil {
+		return &sshError{kind: sshErrCommand, host: s.addr, err: err}
+	}
+	return nil
+}
+
+// Close closes the node and bastion connections
+func (s *sshConn) Close() error {
+	err := s.client.Close()
+	if s.bastion != nil {
+		s.bastion.Close()
+	}
+	return err
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15000*time.Millisecond)
-	defer cancel()
+// sshRun dials target via the bastion and runs cmd, retrying up to attempts times while
+// the nodes refuse connections or the command fails because they are still booting.
+// Authentication and host key failures are returned straight away.
+func sshRun(c *sshClientConfig, bastion, target, cmd string, attempts int, timeout time.Duration) ([]byte, error) {
+	return sshRunInput(c, bastion, target, cmd, nil, attempts, timeout)
+}
+
+// sshRunInput is sshRun with input on the stdin of cmd
+func sshRunInput(c *sshClientConfig, bastion, target, cmd string, input []byte, attempts int, timeout time.Duration) (out []byte, err error) {
+	for i := 1; i <= attempts; i++ {
+		var conn *sshConn
+		conn, err = dialSSH(c, bastion, target)
+		if err == nil {
+			out, err = conn.runInput(cmd, input, timeout)
+			conn.Close()
+		}
+		if err == nil || isSSHError(err, sshErrAuth) || isSSHError(err, sshErrHostKey) {
+			return out, err
+		}
+		if i < attempts {
+			time.Sleep(time.Second * 2)
+		}
+	}
+	return nil, err
+}
 
+// sshExtractKubeConfig will shell in to the cluster main via bastion to
+// pull out the kubeconfig, naming its cluster, user and context after the cluster
+func sshExtractKubeConfig(sshcfg *sshClientConfig, ipBastion, ipClusterMain, clusterName string) ([]byte, error) {
 	log.Println("Getting K3s kubeconfig.")
 
-	cmd := exec.CommandContext(ctx, "ssh",
-		"-A",
-		"-o", "StrictHostKeyChecking=no",
-		"-J", "ec2-user@"+ipBastion,
-		"ec2-user@"+ipClusterMain,
-		"sudo cat /etc/rancher/k3s/k3s.yaml",
-	)
-	// finally get token as output
-	out, err := cmd.Output()
+	out, err := sshRun(sshcfg, ipBastion, ipClusterMain, "sudo cat /etc/rancher/k3s/k3s.yaml", 10, 15*time.Second)
 	if err != nil {
-		log.Fatalf("failed to get k3s token from k3s main %q via bastion %q , %v", ipClusterMain, ipBastion, err)
+		return nil, fmt.Errorf("failed to get k3s kubeconfig from k3s main %q via bastion %q, %v", ipClusterMain, ipBastion, err)
 	}
 	if len(out) < 50 {
-		log.Fatalf("Something went wrong, expecting long token string.\n")
+		return nil, fmt.Errorf("Something went wrong, expecting long kubeconfig string")
 	}
 
-	// replace default with cluster name and loopback ip with cluster main ip
-	kubecfg := strings.Replace(string(out), "default", clusterName, -1)
-	return []byte(kubecfg)
+	return renameKubeConfig(out, "default", clusterName)
 }
 
-// sshExtractToken ssh in to cluster main via the bastion to extract the k3s cluster token value
-// needed by worker nodes to join the cluster.
-func sshExtractToken(awscfg aws.Config, k3scfg *cfg, idBastion, idMain string) string {
-	log.Println("Getting K3s token.")
-
+// fetchKubeConfig waits for the cluster main to be running and to have finished the k3s
+// install, then pulls its kubeconfig via the bastion and writes it to ./k3s_kubeconfig
+func fetchKubeConfig(awscfg aws.Config, k3scfg *cfg, ipBastion, idMain string) error {
 	// Using the Config value, create the s3 client
 	client := ec2.NewFromConfig(awscfg)
 
-	// lookup instances
-	_, _, _, ipBastion := describeInstance(client, k3scfg, "-bastion", idBastion)
-
 	// loop waiting for instance state
-	var ipClusterMain []string
-	var inState []int32
+	var ipClusterMain string
 	numChecks := 45
 
 	log.Println("Waiting on instance state of 'ready'.")
 	for i := 1; i <= numChecks; i++ {
-		_, inState, ipClusterMain, _ = describeInstance(client, k3scfg, "-main", idMain)
-		if inState[0] == 16 {
-			break
+		instances, err := describeInstancesByID(client, []string{idMain})
+		if err != nil {
+			return err
 		}
-		time.Sleep(time.Second * 2)
-	}
-	if ipClusterMain[0] == "" {
-		log.Fatalf("failed to get instance state of 'ready' for instance with id %q\n", idMain)
-	}
-
-	// sleep a few seconds to give instance time to be able to run ssh command
-
-	// shell command via ssh proxy to get token
-	ctx, cancel := context.WithTimeout(context.Background(), 80000*time.Millisecond)
-	defer cancel()
-
-	//cmd := exec.CommandContext(ctx, "ssh",
-	//	"-A",
-	//	"-o AddKeysToAgent=yes",
-	//	"-o StrictHostKeyChecking=no",
-	//	"-J ec2-user@"+ipBastion,
-	//	"ec2-user@"+ipClusterMain,
-	//	"sudo cat /var/lib/rancher/k3s/server/node-token",
-	//)
-
-	// breaking this up in to two steps to avoid the fingerprint confirm
-	// interaction, which should be turned off with StrictHostKeyChecking=no
-	// but still being prompted.
-	var out []byte
-	var err error
-	numSSHChecks := 10
-	for i := 1; i <= numSSHChecks; i++ {
-		cmd := exec.CommandContext(ctx, "ssh",
-			"-A",
-			"-o", "StrictHostKeyChecking=no",
-			"ec2-user@"+ipBastion[0],
-		)
-		_, err := cmd.Output()
-		if err == nil {
+		// 16 - running
+		if v, ok := instances[idMain]; ok && *v.State.Code == 16 {
+			ipClusterMain = aws.ToString(v.PrivateIpAddress)
 			break
 		}
-		time.Sleep(time.Second * 2)
+		if err := sleep(time.Second * 2); err != nil {
+			return err
+		}
+	}
+	if ipClusterMain == "" {
+		return fmt.Errorf("failed to get instance state of 'ready' for instance with id %q", idMain)
 	}
 
-	for i := 1; i <= numSSHChecks; i++ {
-		cmd := exec.CommandContext(ctx, "ssh",
-			"-A",
-			"-o", "StrictHostKeyChecking=no",
-			"-J", "ec2-user@"+ipBastion[0],
-			"ec2-user@"+ipClusterMain[0],
-			"sudo cat /var/lib/rancher/k3s/server/node-token",
-		)
-		out, err = cmd.Output()
-		if err == nil {
-			break
+	// pin the main host keys before connecting so the kubeconfig is only read from the real main
+	if err := waitHostKeys(client, k3scfg, idMain, ipClusterMain); err != nil {
+		return err
+	}
+	if err := checkInterrupted(); err != nil {
+		return err
+	}
+
+	// the kubeconfig only exists once the k3s install in user data has finished so
+	// keep retrying the command and not only the connection
+	log.Println("Waiting on k3s install to finish on cluster main.")
+	_, err := sshRun(k3scfg.sshConfig, ipBastion, ipClusterMain, "sudo test -s /etc/rancher/k3s/k3s.yaml", 40, 15*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to wait on k3s install on k3s main %q via bastion %q, %v", ipClusterMain, ipBastion, err)
+	}
+
+	// get kubeconfig and write to file
+	kubecfg, err := sshExtractKubeConfig(k3scfg.sshConfig, ipBastion, ipClusterMain, k3scfg.clusterName)
+	if err != nil {
+		return err
+	}
+	if k3scfg.apiHost != "" {
+		if kubecfg, err = setKubeConfigServer(kubecfg, k3scfg.clusterName, "https://"+net.JoinHostPort(k3scfg.apiHost, k3sAPIPort)); err != nil {
+			return err
 		}
-		time.Sleep(time.Second * 2)
 	}
+	if err := ioutil.WriteFile("./k3s_kubeconfig", kubecfg, 0600); err != nil {
+		return fmt.Errorf("failed to write kubeconfig, %v", err)
+	}
+	return nil
+}
 
+// lookupBastion returns the public IP of the cluster bastion, pinning its host keys if they
+// are not pinned yet
+func lookupBastion(client *ec2.Client, k3scfg *cfg) (string, error) {
+	idsBastion, _, _, ipPub, err := describeInstance(client, k3scfg, "-bastion", "")
 	if err != nil {
-		log.Fatalf("failed to get k3s token from k3s main %q via bastion %q , %v", ipClusterMain[0], ipBastion[0], err)
+		return "", err
 	}
-	if len(out) < 50 {
-		log.Fatalf("Something went wrong, expecting long token string.\n")
+	if len(ipPub) == 0 || ipPub[0] == "" {
+		return "", fmt.Errorf("no running bastion with a public ip found for cluster %q", k3scfg.clusterName)
+	}
+	if err := ensureHostKeys(client, k3scfg, idsBastion[0], ipPub[0]); err != nil {
+		return "", err
 	}
+	return ipPub[0], nil
+}
 
-	// get kubeconfig and write to file
-	err = ioutil.WriteFile("./k3s_kubeconfig", sshExtractKubeConfig(ipBastion[0], ipClusterMain[0], k3scfg.clusterName), 0644)
+// lookupBastionNode returns the public IP of the cluster bastion and the private IP of
+// the cluster node with the name suffix node (e.g. main, worker-01), pinning their host
+// keys if they are not pinned yet
+func lookupBastionNode(client *ec2.Client, k3scfg *cfg, node string) (ipBastion, ipNode string, err error) {
+	ipBastion, err = lookupBastion(client, k3scfg)
+	if err != nil {
+		return "", "", err
+	}
+
+	idsNode, _, ipPri, _, err := describeInstance(client, k3scfg, "-"+node, "")
 	if err != nil {
-		log.Fatalf("Failed to write kubeconfig.\n")
+		return "", "", err
+	}
+	if len(ipPri) == 0 || ipPri[0] == "" {
+		return "", "", fmt.Errorf("no running node %q found for cluster %q", node, k3scfg.clusterName)
+	}
+	if err := ensureHostKeys(client, k3scfg, idsNode[0], ipPri[0]); err != nil {
+		return "", "", err
 	}
 
-	return strings.TrimSuffix(string(out), "\n")
+	return ipBastion, ipPri[0], nil
+}
+
+// lookupServers returns the instance ids and private IPs of the k3s servers of the cluster
+// that have not been terminated, the main first
+func lookupServers(client *ec2.Client, k3scfg *cfg) (ids, ips []string, err error) {
+	// tag filters match * as a wildcard
+	for _, suffix := range []string{"-main", "-server-*"} {
+		idsServer, _, ipPri, _, err := describeInstance(client, k3scfg, suffix, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, v := range ipPri {
+			if v != "" {
+				ids = append(ids, idsServer[i])
+				ips = append(ips, v)
+			}
+		}
+	}
+	return ids, ips, nil
 }
 
-// sshAgent uses os exec command to add key to ssh-agent
-func sshAgent(keyPath string) {
-	_, err := os.Stat(keyPath)
-	if os.IsNotExist(err) {
-		log.Fatalf("the key file %q does not exist, %v", keyPath, err)
+// extractServerKubeConfig pulls the kubeconfig via the bastion from the first server that
+// answers, the main first, so it can be fetched while any server of a HA cluster is up
+func extractServerKubeConfig(client *ec2.Client, k3scfg *cfg, ipBastion string) ([]byte, error) {
+	ids, ips, err := lookupServers(client, k3scfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no server found for cluster %q", k3scfg.clusterName)
+	}
+
+	for i, ip := range ips {
+		if err = ensureHostKeys(client, k3scfg, ids[i], ip); err != nil {
+			log.Printf("skipping server %q, %v", ip, err)
+			continue
+		}
+		var kubecfg []byte
+		if kubecfg, err = sshExtractKubeConfig(k3scfg.sshConfig, ipBastion, ip, k3scfg.clusterName); err == nil {
+			return kubecfg, nil
+		}
+		log.Printf("%v", err)
 	}
+	return nil, err
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3000*time.Millisecond)
-	defer cancel()
+// writeKubeConfig pulls the kubeconfig from a cluster server via the bastion and writes it to
+// path, pointing it at the API load balancer if the cluster has one
+func writeKubeConfig(awscfg aws.Config, k3scfg *cfg, path string) error {
+	// Using the Config value, create the ec2 client
+	client := ec2.NewFromConfig(awscfg)
 
-	if err := exec.CommandContext(ctx, "ssh-add", keyPath).Run(); err != nil {
-		log.Fatalf("failed to add key %q to ssh agent, %v", keyPath, err)
+	ipBastion, err := lookupBastion(client, k3scfg)
+	if err != nil {
+		return fmt.Errorf("failed to lookup cluster instances, %v", err)
+	}
+
+	kubecfg, err := extractServerKubeConfig(client, k3scfg, ipBastion)
+	if err != nil {
+		return err
+	}
+	endpoint, err := apiEndpoint(awscfg, k3scfg)
+	if err != nil {
+		return err
+	}
+	if endpoint != "" {
+		if kubecfg, err = setKubeConfigServer(kubecfg, k3scfg.clusterName, "https://"+endpoint); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(path, kubecfg, 0600); err != nil {
+		return fmt.Errorf("failed to write kubeconfig to %q, %v", path, err)
+	}
+
+	log.Printf("Wrote kubeconfig for cluster %q to %q", k3scfg.clusterName, path)
+	return nil
+}
+
+// sshNode opens an interactive ssh session to the cluster node via the bastion
+func sshNode(awscfg aws.Config, k3scfg *cfg, node string) error {
+	// Using the Config value, create the ec2 client
+	client := ec2.NewFromConfig(awscfg)
+
+	ipBastion, ipNode, err := lookupBastionNode(client, k3scfg, node)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialSSH(k3scfg.sshConfig, ipBastion, ipNode)
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 
-	log.Printf("Added key %q to ssh agnet", keyPath)
+	return conn.shell()
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newTestSigner returns a fresh ed25519 signer
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// testSSHServer is an in-process ssh server that runs "true" and "false" and forwards
+// direct-tcpip channels, enough to stand in for a bastion and a node
+type testSSHServer struct {
+	addr    string
+	hostKey ssh.Signer
+	ln      net.Listener
+}
+
+// newTestSSHServer starts a server accepting only the key authorized
+func newTestSSHServer(t *testing.T, authorized ssh.PublicKey) *testSSHServer {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("key not authorized")
+		},
+	}
+	hostKey := newTestSigner(t)
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{addr: ln.Addr().String(), hostKey: hostKey, ln: ln}
+	t.Cleanup(s.close)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+// close stops accepting connections
+func (s *testSSHServer) close() {
+	s.ln.Close()
+}
+
+// serve handles the channels of one connection
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			go serveSession(nc)
+		case "direct-tcpip":
+			go serveDirectTCPIP(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// serveSession runs exec requests, "true" exits 0 and anything else exits 1
+func serveSession(nc ssh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+
+		status := uint32(1)
+		if payload.Command == "true" {
+			io.WriteString(ch, "ok")
+			status = 0
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// serveDirectTCPIP connects the channel to the address it asks for, as sshd does for ssh -J
+func serveDirectTCPIP(nc ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+	ch.Close()
+}
+
+// closedAddr returns an address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// writeKnownHosts pins key for each addr in a known_hosts file and returns its path
+func writeKnownHosts(t *testing.T, pins map[string]ssh.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	var data []byte
+	for addr, key := range pins {
+		data = append(data, knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)+"\n"...)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSSHRunErrorKinds(t *testing.T) {
+	clientKey := newTestSigner(t)
+	otherKey := newTestSigner(t)
+
+	bastion := newTestSSHServer(t, clientKey.PublicKey())
+	node := newTestSSHServer(t, clientKey.PublicKey())
+	lockedNode := newTestSSHServer(t, otherKey.PublicKey())
+	down := closedAddr(t)
+
+	pinned := map[string]ssh.PublicKey{
+		bastion.addr:    bastion.hostKey.PublicKey(),
+		node.addr:       node.hostKey.PublicKey(),
+		lockedNode.addr: lockedNode.hostKey.PublicKey(),
+	}
+	changed := map[string]ssh.PublicKey{
+		bastion.addr: bastion.hostKey.PublicKey(),
+		node.addr:    otherKey.PublicKey(),
+	}
+
+	tests := []struct {
+		name       string
+		knownHosts string
+		bastion    string
+		target     string
+		cmd        string
+		wantErr    bool
+		wantKind   sshErrorKind
+		wantHost   string
+	}{
+		{name: "bastion command ok", knownHosts: writeKnownHosts(t, pinned), bastion: bastion.addr, cmd: "true"},
+		{name: "jump command ok", knownHosts: writeKnownHosts(t, pinned), bastion: bastion.addr, target: node.addr, cmd: "true"},
+		{name: "bastion command fails", knownHosts: writeKnownHosts(t, pinned), bastion: bastion.addr, cmd: "false",
+			wantErr: true, wantKind: sshErrCommand, wantHost: bastion.addr},
+		{name: "jump command fails", knownHosts: writeKnownHosts(t, pinned), bastion: bastion.addr, target: node.addr, cmd: "false",
+			wantErr: true, wantKind: sshErrCommand, wantHost: node.addr},
+		{name: "bastion refuses connection", knownHosts: writeKnownHosts(t, pinned), bastion: down, cmd: "true",
+			wantErr: true, wantKind: sshErrConnect, wantHost: down},
+		{name: "jump target refuses connection", knownHosts: writeKnownHosts(t, pinned), bastion: bastion.addr, target: down, cmd: "true",
+			wantErr: true, wantKind: sshErrConnect, wantHost: down},
+		{name: "bastion rejects key", knownHosts: writeKnownHosts(t, pinned), bastion: lockedNode.addr, cmd: "true",
+			wantErr: true, wantKind: sshErrAuth, wantHost: lockedNode.addr},
+		{name: "jump target rejects key", knownHosts: writeKnownHosts(t, pinned), bastion: bastion.addr, target: lockedNode.addr, cmd: "true",
+			wantErr: true, wantKind: sshErrAuth, wantHost: lockedNode.addr},
+		{name: "no pinned host keys", knownHosts: filepath.Join(t.TempDir(), "known_hosts"), bastion: bastion.addr, cmd: "true",
+			wantErr: true, wantKind: sshErrHostKey, wantHost: bastion.addr},
+		{name: "jump target host unknown", knownHosts: writeKnownHosts(t, map[string]ssh.PublicKey{bastion.addr: bastion.hostKey.PublicKey()}),
+			bastion: bastion.addr, target: node.addr, cmd: "true", wantErr: true, wantKind: sshErrHostKey, wantHost: node.addr},
+		{name: "jump target host key changed", knownHosts: writeKnownHosts(t, changed), bastion: bastion.addr, target: node.addr, cmd: "true",
+			wantErr: true, wantKind: sshErrHostKey, wantHost: node.addr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &sshClientConfig{
+				user:            "ec2-user",
+				signer:          clientKey,
+				hostKeyCallback: knownHostsCallback(tt.knownHosts),
+				timeout:         5 * time.Second,
+			}
+			out, err := sshRun(c, tt.bastion, tt.target, tt.cmd, 1, 5*time.Second)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error, %v", err)
+				}
+				if string(out) != "ok" {
+					t.Fatalf("got output %q, want %q", out, "ok")
+				}
+				return
+			}
+
+			if !isSSHError(err, tt.wantKind) {
+				t.Fatalf("got error %v, want an sshError of kind %q", err, tt.wantKind)
+			}
+			if e := err.(*sshError); e.host != tt.wantHost {
+				t.Fatalf("got error for host %q, want %q", e.host, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestSSHAddr(t *testing.T) {
+	tests := []struct{ host, want string }{
+		{"10.0.0.1", "10.0.0.1:22"},
+		{"10.0.0.1:2222", "10.0.0.1:2222"},
+		{"bastion.example.com", "bastion.example.com:22"},
+	}
+	for _, tt := range tests {
+		if got := sshAddr(tt.host); got != tt.want {
+			t.Errorf("sshAddr(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
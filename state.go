@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// stateVersion is the version of the state file layout written by this release
+const stateVersion = 1
+
+// stateInstance is an instance created by a deploy
+type stateInstance struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Subnet    string `json:"subnet"`
+	PrivateIP string `json:"privateIp,omitempty"`
+}
+
+// stateSecurityGroup is a security group created by a deploy
+type stateSecurityGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// stateLoadBalancer is the API load balancer and its target group created by a deploy
+type stateLoadBalancer struct {
+	ARN            string `json:"arn,omitempty"`
+	Name           string `json:"name,omitempty"`
+	DNSName        string `json:"dnsName,omitempty"`
+	TargetGroupARN string `json:"targetGroupArn"`
+}
+
+// stateDatastore is the RDS datastore and its subnet group created by a deploy
+type stateDatastore struct {
+	Engine      string `json:"engine"`
+	Identifier  string `json:"identifier,omitempty"`
+	SubnetGroup string `json:"subnetGroup"`
+	Endpoint    string `json:"endpoint,omitempty"`
+}
+
+// clusterState records every resource a deploy created. It is saved after every change
+// so a deploy that dies half way still leaves a record of what it created.
+type clusterState struct {
+	Version        int                  `json:"version"`
+	Name           string               `json:"name"`
+	Region         string               `json:"region"`
+	CreatedAt      time.Time            `json:"createdAt"`
+	K3sVersion     string               `json:"k3sVersion"`
+	Servers        int32                `json:"servers,omitempty"`
+	AMI            string               `json:"ami"`
+	AMIs           map[string]string    `json:"amis,omitempty"`
+	Image          string               `json:"image,omitempty"`
+	SSHUser        string               `json:"sshUser,omitempty"`
+	VPC            string               `json:"vpc"`
+	Subnets        []string             `json:"subnets"`
+	Bastion        string               `json:"bastion"`
+	Instances      []stateInstance      `json:"instances"`
+	SecurityGroups []stateSecurityGroup `json:"securityGroups"`
+	LoadBalancer   *stateLoadBalancer   `json:"loadBalancer,omitempty"`
+	Datastore      *stateDatastore      `json:"datastore,omitempty"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// statePath returns the path of the state file of the cluster
+func statePath(clusterName string) (string, error) {
+	dir, err := clusterDir(clusterName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "state.json"), nil
+}
+
+// newClusterState starts the state of a new deploy, refusing to replace the state of a
+// cluster that still has resources recorded
+func newClusterState(k3scfg *cfg, region string) (*clusterState, error) {
+	existing, err := loadClusterState(k3scfg.clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && (len(existing.Instances) > 0 || len(existing.SecurityGroups) > 0 || existing.LoadBalancer != nil || existing.Datastore != nil) {
+		return nil, fmt.Errorf("cluster %q already has resources recorded in %q, delete the cluster first", k3scfg.clusterName, existing.path)
+	}
+
+	path, err := statePath(k3scfg.clusterName)
+	if err != nil {
+		return nil, err
+	}
+	s := &clusterState{
+		Version:    stateVersion,
+		Name:       k3scfg.clusterName,
+		Region:     region,
+		CreatedAt:  time.Now().UTC(),
+		K3sVersion: k3scfg.k3sVersion,
+		Servers:    k3scfg.servers,
+		Subnets:    k3scfg.subnets,
+		path:       path,
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadClusterState reads the state file of the cluster, returning nil if there is none
+func loadClusterState(clusterName string) (*clusterState, error) {
+	path, err := statePath(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %q, %v", path, err)
+	}
+
+	s := &clusterState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %q, %v", path, err)
+	}
+	if s.Version != stateVersion {
+		return nil, fmt.Errorf("state file %q has unsupported version %d", path, s.Version)
+	}
+	s.path = path
+
+	return s, nil
+}
+
+// save writes the state file, replacing it atomically so a crash never leaves it truncated
+func (s *clusterState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state, %v", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write state file %q, %v", tmp, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write state file %q, %v", s.path, err)
+	}
+	return nil
+}
+
+// update applies fn to the state and saves it. It is safe to call concurrently and does
+// nothing on a nil state so callers outside of create don't need to check. A failed save
+// is only logged since the in memory state is still enough to roll back.
+func (s *clusterState) update(fn func(s *clusterState)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(s)
+	if err := s.save(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// addInstance records an instance as soon as it exists, before it is tagged
+func (s *clusterState) addInstance(v types.Instance, name, role string) {
+	s.update(func(s *clusterState) {
+		inst := stateInstance{ID: *v.InstanceId, Name: name, Role: role}
+		if v.SubnetId != nil {
+			inst.Subnet = *v.SubnetId
+		}
+		if v.PrivateIpAddress != nil {
+			inst.PrivateIP = *v.PrivateIpAddress
+		}
+		s.Instances = append(s.Instances, inst)
+		if role == "bastion" {
+			s.Bastion = inst.ID
+		}
+	})
+}
+
+// addSecurityGroup records a security group as soon as it exists
+func (s *clusterState) addSecurityGroup(id, name string) {
+	s.update(func(s *clusterState) {
+		s.SecurityGroups = append(s.SecurityGroups, stateSecurityGroup{ID: id, Name: name})
+	})
+}
+
+// instanceIDs returns the ids of every recorded instance
+func (s *clusterState) instanceIDs() (ids []string) {
+	if s == nil {
+		return nil
+	}
+	for _, v := range s.Instances {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+// securityGroupIDs returns the ids of every recorded security group
+func (s *clusterState) securityGroupIDs() (ids []string) {
+	if s == nil {
+		return nil
+	}
+	for _, v := range s.SecurityGroups {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+// removeClusterDir deletes the local state, token and known_hosts of a destroyed cluster
+func removeClusterDir(clusterName string) {
+	dir, err := clusterDir(clusterName)
+	if err != nil {
+		log.Printf("failed to remove cluster directory, %v", err)
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("failed to remove cluster directory %q, %v", dir, err)
+	}
+}
+
+// describeInstancesByID returns every instance in ids that still exists, using a filter so
+// ids that no longer exist are skipped instead of failing the call
+func describeInstancesByID(client *ec2.Client, ids []string) (map[string]types.Instance, error) {
+	instances := map[string]types.Instance{}
+	if len(ids) == 0 {
+		return instances, nil
+	}
+
+	var instanceID = "instance-id"
+	describeInput := &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   &instanceID,
+				Values: ids,
+			},
+		},
+	}
+
+	paginator := ec2.NewDescribeInstancesPaginator(client, describeInput)
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances, %v", err)
+		}
+		for _, v := range result.Reservations {
+			for _, k := range v.Instances {
+				instances[*k.InstanceId] = k
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+// describeSGsByID returns the security groups in ids that still exist
+func describeSGsByID(client *ec2.Client, ids []string) (map[string]types.SecurityGroup, error) {
+	found := map[string]types.SecurityGroup{}
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	var groupID = "group-id"
+	describeInput := &ec2.DescribeSecurityGroupsInput{
+		Filters: []types.Filter{
+			{
+				Name:   &groupID,
+				Values: ids,
+			},
+		},
+	}
+
+	result, err := client.DescribeSecurityGroups(context.TODO(), describeInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe security groups, %v", err)
+	}
+	for _, v := range result.SecurityGroups {
+		found[*v.GroupId] = v
+	}
+
+	return found, nil
+}
+
+// reconciliation is the result of comparing the state file with tag discovery
+type reconciliation struct {
+	// instances and securityGroups are every live resource from either source
+	instances      []string
+	securityGroups []string
+
+	// untagged are live resources in the state file that tag discovery missed,
+	// unrecorded are tagged resources missing from the state file and gone are
+	// resources in the state file that no longer exist
+	untagged   []string
+	unrecorded []string
+	gone       []string
+}
+
+// agree reports whether the state file and the tags found the same resources
+func (r *reconciliation) agree() bool {
+	return len(r.untagged) == 0 && len(r.unrecorded) == 0 && len(r.gone) == 0
+}
+
+// reconcile finds the live resources of the cluster from the state file, if any, and the
+// cluster tags, reporting where the two disagree
+func reconcile(client *ec2.Client, k3scfg *cfg, state *clusterState) (*reconciliation, error) {
+	r := &reconciliation{}
+
+	// tag discovery
+	taggedIn, _, _, _, err := describeInstance(client, k3scfg, "", "")
+	if err != nil {
+		return nil, err
+	}
+	taggedSG, err := describeSG(client, k3scfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a state file tags are all there is
+	if state == nil {
+		r.instances = taggedIn
+		r.securityGroups = taggedSG
+		return r, nil
+	}
+
+	liveIn, err := describeInstancesByID(client, state.instanceIDs())
+	if err != nil {
+		return nil, err
+	}
+	liveSG, err := describeSGsByID(client, state.securityGroupIDs())
+	if err != nil {
+		return nil, err
+	}
+
+	r.instances, r.untagged, r.unrecorded, r.gone = mergeIDs(state.instanceIDs(), taggedIn, func(id string) bool {
+		v, ok := liveIn[id]
+		// 48 - terminated
+		return ok && *v.State.Code != 48
+	})
+
+	var untagged, unrecorded, gone []string
+	r.securityGroups, untagged, unrecorded, gone = mergeIDs(state.securityGroupIDs(), taggedSG, func(id string) bool {
+		_, ok := liveSG[id]
+		return ok
+	})
+	r.untagged = append(r.untagged, untagged...)
+	r.unrecorded = append(r.unrecorded, unrecorded...)
+	r.gone = append(r.gone, gone...)
+
+	return r, nil
+}
+
+// mergeIDs merges the recorded and tagged ids of one resource type, where live reports if a
+// recorded id still exists
+func mergeIDs(recorded, tagged []string, live func(id string) bool) (all, untagged, unrecorded, gone []string) {
+	isTagged := map[string]bool{}
+	for _, v := range tagged {
+		isTagged[v] = true
+	}
+	isRecorded := map[string]bool{}
+	for _, v := range recorded {
+		isRecorded[v] = true
+	}
+
+	for _, v := range recorded {
+		switch {
+		case isTagged[v]:
+			all = append(all, v)
+		case live(v):
+			all = append(all, v)
+			untagged = append(untagged, v)
+		default:
+			gone = append(gone, v)
+		}
+	}
+	for _, v := range tagged {
+		if !isRecorded[v] {
+			all = append(all, v)
+			unrecorded = append(unrecorded, v)
+		}
+	}
+
+	sort.Strings(all)
+	return all, untagged, unrecorded, gone
+}
+
+// printReconciliation prints where the state file and tag discovery disagree
+func printReconciliation(k3scfg *cfg, state *clusterState, r *reconciliation) {
+	if state == nil {
+		fmt.Printf("\nNo state file found for the %q cluster, resources were found by tags only.\n", k3scfg.clusterName)
+		return
+	}
+	if r.agree() {
+		return
+	}
+
+	fmt.Printf("\nThe state file %q and the cluster tags disagree:\n", state.path)
+	for _, v := range r.untagged {
+		fmt.Printf("  %s is in the state file but not tagged, tagging likely failed.\n", v)
+	}
+	for _, v := range r.unrecorded {
+		fmt.Printf("  %s is tagged but not in the state file.\n", v)
+	}
+	for _, v := range r.gone {
+		fmt.Printf("  %s is in the state file but no longer exists.\n", v)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceStates maps EC2 instance state codes to their names
+var instanceStates = map[int32]string{
+	0:  "pending",
+	16: "running",
+	32: "shutting-down",
+	48: "terminated",
+	64: "stopping",
+	80: "stopped",
+}
+
+// clusterStatus prints the state file summary and the health of every instance of the cluster.
+// With an ssh key in k3scfg the k3s readiness and version of each node is read from the k3s API
+// via the bastion. It returns false if nothing was found or anything is unhealthy, and an error
+// if the cluster resources could not be described.
+func clusterStatus(awscfg aws.Config, k3scfg *cfg) (bool, error) {
+	// Using the Config value, create the ec2 client
+	client := ec2.NewFromConfig(awscfg)
+
+	state, err := loadClusterState(k3scfg.clusterName)
+	if err != nil {
+		log.Printf("ignoring state file, %v", err)
+	}
+	r, err := reconcile(client, k3scfg, state)
+	if err != nil {
+		return false, err
+	}
+	if len(r.instances) == 0 && len(r.securityGroups) == 0 {
+		fmt.Printf("No resources found associated with the %q cluster.\n", k3scfg.clusterName)
+		return false, nil
+	}
+
+	if state != nil {
+		fmt.Printf("Cluster:     %s\n", state.Name)
+		fmt.Printf("Region:      %s\n", state.Region)
+		fmt.Printf("Created:     %s\n", state.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+		fmt.Printf("k3s version: %s\n", valueOr(state.K3sVersion, "latest stable"))
+		fmt.Printf("AMI:         %s\n", state.AMI)
+		// worker groups of another architecture have their own AMI
+		for _, arch := range []string{"x86_64", "arm64"} {
+			if id, ok := state.AMIs[arch]; ok && id != state.AMI {
+				fmt.Printf("AMI %-8s %s\n", arch+":", id)
+			}
+		}
+		if state.Image != "" {
+			fmt.Printf("Image:       %s (ssh user %s)\n", state.Image, state.SSHUser)
+		}
+		fmt.Printf("VPC:         %s\n", state.VPC)
+		fmt.Printf("Subnets:     %s\n\n", strings.Join(state.Subnets, ", "))
+	}
+
+	instances, err := describeInstancesByID(client, r.instances)
+	if err != nil {
+		return false, err
+	}
+	volumes, err := describeRootVolumes(client, instances)
+	if err != nil {
+		return false, err
+	}
+
+	// the state knows the role of instances launched untagged by an older release
+	roles := map[string]string{}
+	if state != nil {
+		for _, v := range state.Instances {
+			roles[v.ID] = v.Role
+		}
+	}
+
+	healthy := true
+
+	// k3s readiness needs the ssh key to reach the k3s API through the bastion
+	var nodes map[string]k3sNode
+	if k3scfg.sshConfig != nil {
+		ipBastion, err := lookupBastion(client, k3scfg)
+		if err == nil {
+			nodes, err = getServerK3sNodes(client, k3scfg, ipBastion)
+		}
+		if err != nil {
+			log.Printf("k3s node readiness unavailable, %v", err)
+			healthy = false
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tROLE\tAZ\tPRIVATE IP\tPUBLIC IP\tSTATE\tREADY\tK3S VERSION\tROOT VOLUME")
+	seen := map[string]bool{}
+	for _, id := range r.instances {
+		v, ok := instances[id]
+		if !ok {
+			continue
+		}
+		name := tagValue(v.Tags, tagName)
+		role := roles[id]
+		if role == "" {
+			role = roleOf(k3scfg, name)
+		}
+		if v.InstanceLifecycle == types.InstanceLifecycleTypeSpot {
+			role += " (spot)"
+		}
+		az := ""
+		if v.Placement != nil {
+			az = aws.ToString(v.Placement.AvailabilityZone)
+		}
+
+		// 16 - running
+		if *v.State.Code != 16 {
+			healthy = false
+		}
+
+		ready, version := "-", "-"
+		if role != "bastion" && nodes != nil {
+			ip := aws.ToString(v.PrivateIpAddress)
+			node, ok := nodes[ip]
+			seen[ip] = ok
+			switch {
+			case !ok:
+				ready = "missing"
+				healthy = false
+			case node.ready:
+				ready, version = "Ready", node.version
+			default:
+				ready, version = "NotReady", node.version
+				healthy = false
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", id, valueOr(name, "-"), role, valueOr(az, "-"), valueOr(aws.ToString(v.PrivateIpAddress), "-"), valueOr(aws.ToString(v.PublicIpAddress), "-"), instanceStates[*v.State.Code], ready, version, formatVolume(volumes[id]))
+	}
+	w.Flush()
+
+	// nodes registered with k3s that aren't instances of the cluster
+	for ip, node := range nodes {
+		if !seen[ip] {
+			fmt.Printf("\nk3s node %q (%s) does not match any instance of the cluster.\n", node.name, ip)
+		}
+	}
+	if k3scfg.sshConfig == nil {
+		fmt.Println("\nPass -k with the ssh key to include k3s node readiness.")
+	}
+
+	fmt.Printf("\nSecurity groups: %s\n", strings.Join(r.securityGroups, ", "))
+	printReconciliation(k3scfg, state, r)
+
+	return healthy, nil
+}
+
+// valueOr returns v or def if v is empty
+func valueOr(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"gopkg.in/yaml.v3"
+)
+
+// k3sAPIPort is the port of the k3s API server on the server nodes
+const k3sAPIPort = "6443"
+
+// parseKubeConfig parses kubecfg keeping its layout so it can be edited and encoded again
+func parseKubeConfig(kubecfg []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(kubecfg, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig, %v", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("kubeconfig is empty")
+	}
+	return &doc, nil
+}
+
+// encodeKubeConfig encodes the kubeconfig doc parsed by parseKubeConfig
+func encodeKubeConfig(doc *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, fmt.Errorf("failed to encode kubeconfig, %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renameKubeConfig renames the cluster, user and context called from in kubecfg to to,
+// along with the references to them, leaving every other value as it is
+func renameKubeConfig(kubecfg []byte, from, to string) ([]byte, error) {
+	doc, err := parseKubeConfig(kubecfg)
+	if err != nil {
+		return nil, err
+	}
+	root := doc.Content[0]
+
+	rename := func(node *yaml.Node) {
+		if node != nil && node.Kind == yaml.ScalarNode && node.Value == from {
+			node.Value = to
+		}
+	}
+	for _, key := range []string{"clusters", "users"} {
+		for _, entry := range yamlSeq(yamlValue(root, key)) {
+			rename(yamlValue(entry, "name"))
+		}
+	}
+	for _, entry := range yamlSeq(yamlValue(root, "contexts")) {
+		rename(yamlValue(entry, "name"))
+		rename(yamlValue(yamlValue(entry, "context"), "cluster"))
+		rename(yamlValue(yamlValue(entry, "context"), "user"))
+	}
+	rename(yamlValue(root, "current-context"))
+
+	return encodeKubeConfig(doc)
+}
+
+// setKubeConfigServer points the cluster entry called cluster in kubecfg at server, leaving
+// the other clusters of a shared kubeconfig as they are
+func setKubeConfigServer(kubecfg []byte, cluster, server string) ([]byte, error) {
+	doc, err := parseKubeConfig(kubecfg)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, entry := range yamlSeq(yamlValue(doc.Content[0], "clusters")) {
+		if name := yamlValue(entry, "name"); name == nil || name.Value != cluster {
+			continue
+		}
+		if s := yamlValue(yamlValue(entry, "cluster"), "server"); s != nil {
+			s.Value = server
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no cluster %q with a server found in kubeconfig", cluster)
+	}
+
+	return encodeKubeConfig(doc)
+}
+
+// yamlValue returns the value of key in the mapping node, or nil if it has none
+func yamlValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// yamlSeq returns the items of the sequence node, or nil if it is not a sequence
+func yamlSeq(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return node.Content
+}
+
+// tunnel forwards local connections to the k3s API on the cluster servers through the bastion,
+// redialling the bastion whenever the ssh connection drops. Targets are tried in order so the
+// API stays reachable while any server of a HA cluster is up.
+type tunnel struct {
+	sshcfg  *sshClientConfig
+	bastion string
+	targets []string
+
+	mu   sync.Mutex
+	conn *sshConn
+}
+
+// client returns the current bastion connection, dialling a new one if there is none
+func (t *tunnel) client() (*sshConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		return t.conn, nil
+	}
+
+	var err error
+	numChecks := 5
+	for i := 1; i <= numChecks; i++ {
+		var conn *sshConn
+		conn, err = dialSSH(t.sshcfg, t.bastion, "")
+		if err == nil {
+			t.conn = conn
+			return conn, nil
+		}
+		if isSSHError(err, sshErrAuth) || isSSHError(err, sshErrHostKey) {
+			break
+		}
+		time.Sleep(time.Second * time.Duration(i))
+	}
+	return nil, err
+}
+
+// drop closes conn if it is still the current bastion connection so the next use redials
+func (t *tunnel) drop(conn *sshConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == conn {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// keepalive checks the bastion connection every interval and reconnects when it has dropped
+func (t *tunnel) keepalive(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		conn, err := t.client()
+		if err != nil {
+			log.Printf("failed to reconnect to bastion %q, %v", t.bastion, err)
+			continue
+		}
+		if _, _, err := conn.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			log.Printf("Lost connection to bastion %q, reconnecting.", t.bastion)
+			t.drop(conn)
+			if _, err := t.client(); err == nil {
+				log.Printf("Reconnected to bastion %q.", t.bastion)
+			}
+		}
+	}
+}
+
+// forward copies local to the target via the bastion until either side closes
+func (t *tunnel) forward(local net.Conn) {
+	defer local.Close()
+
+	// retry once on a fresh bastion connection in case the current one went stale
+	var remote net.Conn
+	for i := 1; i <= 2 && remote == nil; i++ {
+		conn, err := t.client()
+		if err != nil {
+			log.Printf("failed to connect to bastion %q, %v", t.bastion, err)
+			return
+		}
+		for _, target := range t.targets {
+			remote, err = conn.client.Dial("tcp", target)
+			if err == nil {
+				break
+			}
+			log.Printf("failed to forward to %q via bastion %q, %v", target, t.bastion, err)
+		}
+		if remote == nil {
+			t.drop(conn)
+		}
+	}
+	if remote == nil {
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// runTunnel listens on the local port, 0 to pick a free one, and forwards to the k3s API of
+// the cluster until interrupted. Connections go to the API load balancer if the cluster has
+// one, else to the main, falling back to the other servers in turn while it is down. The
+// kubeconfig at path is rewritten to use the tunnel, fetching it from a server first if it
+// doesn't exist.
+func runTunnel(awscfg aws.Config, k3scfg *cfg, port int, path string) error {
+	// Using the Config value, create the ec2 client
+	client := ec2.NewFromConfig(awscfg)
+
+	ipBastion, err := lookupBastion(client, k3scfg)
+	if err != nil {
+		return err
+	}
+	_, ipServers, err := lookupServers(client, k3scfg)
+	if err != nil {
+		return err
+	}
+	if len(ipServers) == 0 {
+		return fmt.Errorf("no server found for cluster %q", k3scfg.clusterName)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("failed to listen on local port %d, %v", port, err)
+	}
+	localAddr := listener.Addr().String()
+
+	var kubecfg []byte
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if kubecfg, err = extractServerKubeConfig(client, k3scfg, ipBastion); err != nil {
+			listener.Close()
+			return err
+		}
+	} else if kubecfg, err = ioutil.ReadFile(path); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to read kubeconfig %q, %v", path, err)
+	}
+	if kubecfg, err = setKubeConfigServer(kubecfg, k3scfg.clusterName, "https://"+localAddr); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to point kubeconfig %q at the tunnel, %v", path, err)
+	}
+	if err := ioutil.WriteFile(path, kubecfg, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to write kubeconfig %q, %v", path, err)
+	}
+
+	// prefer the API load balancer, falling back to the servers directly
+	t := &tunnel{
+		sshcfg:  k3scfg.sshConfig,
+		bastion: ipBastion,
+	}
+	endpoint, err := apiEndpoint(awscfg, k3scfg)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	if endpoint != "" {
+		t.targets = append(t.targets, endpoint)
+	}
+	for _, ip := range ipServers {
+		t.targets = append(t.targets, net.JoinHostPort(ip, k3sAPIPort))
+	}
+	if _, err := t.client(); err != nil {
+		listener.Close()
+		return err
+	}
+
+	stop := make(chan struct{})
+	go t.keepalive(15*time.Second, stop)
+
+	// close the listener on Ctrl-C so Accept returns and the tunnel shuts down
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		close(stop)
+		listener.Close()
+	}()
+
+	log.Printf("Forwarding %s to %s via bastion %s.", localAddr, strings.Join(t.targets, ", "), ipBastion)
+	fmt.Printf("\nTunnel is up, press Ctrl-C to stop. In another terminal run:\n\n  KUBECONFIG=%s kubectl get nodes\n\n", path)
+
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				log.Println("Closing tunnel.")
+				t.mu.Lock()
+				if t.conn != nil {
+					t.conn.Close()
+				}
+				t.mu.Unlock()
+				return nil
+			default:
+				return fmt.Errorf("failed to accept local connection, %v", err)
+			}
+		}
+		go t.forward(local)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testKubeConfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: LS0tLS1CRUdJTg==
+    server: https://10.1.2.3:6443
+  name: other
+- cluster:
+    certificate-authority-data: LS0tLS1CRUdJTg==
+    server: https://127.0.0.1:6443
+  name: my-cluster
+contexts:
+- context:
+    cluster: my-cluster
+    user: my-cluster
+  name: my-cluster
+current-context: my-cluster
+kind: Config
+`
+
+func TestSetKubeConfigServer(t *testing.T) {
+	out, err := setKubeConfigServer([]byte(testKubeConfig), "my-cluster", "https://127.0.0.1:41234")
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	var kubecfg struct {
+		Clusters []struct {
+			Name    string `yaml:"name"`
+			Cluster struct {
+				Server string `yaml:"server"`
+				CA     string `yaml:"certificate-authority-data"`
+			} `yaml:"cluster"`
+		} `yaml:"clusters"`
+		CurrentContext string `yaml:"current-context"`
+	}
+	if err := yaml.Unmarshal(out, &kubecfg); err != nil {
+		t.Fatalf("failed to parse rewritten kubeconfig, %v", err)
+	}
+
+	want := map[string]string{
+		"other":      "https://10.1.2.3:6443",
+		"my-cluster": "https://127.0.0.1:41234",
+	}
+	if len(kubecfg.Clusters) != len(want) {
+		t.Fatalf("got %d clusters, want %d", len(kubecfg.Clusters), len(want))
+	}
+	for _, c := range kubecfg.Clusters {
+		if c.Cluster.Server != want[c.Name] {
+			t.Errorf("cluster %q has server %q, want %q", c.Name, c.Cluster.Server, want[c.Name])
+		}
+		if c.Cluster.CA == "" {
+			t.Errorf("cluster %q lost its certificate authority", c.Name)
+		}
+	}
+	if kubecfg.CurrentContext != "my-cluster" {
+		t.Errorf("got current-context %q, want %q", kubecfg.CurrentContext, "my-cluster")
+	}
+
+	if _, err := setKubeConfigServer([]byte(testKubeConfig), "missing", "https://127.0.0.1:41234"); err == nil {
+		t.Error("expected an error for a cluster not in the kubeconfig")
+	}
+}
+
+// k3s names its cluster, user and context default, the word also shows up in values
+const testK3sKubeConfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: ZGVmYXVsdA==
+    server: https://127.0.0.1:6443
+  name: default
+contexts:
+- context:
+    cluster: default
+    namespace: default
+    user: default
+  name: default
+current-context: default
+kind: Config
+preferences: {}
+users:
+- name: default
+  user:
+    client-certificate-data: ZGVmYXVsdA==
+    token: default-token-x7f2k
+`
+
+func TestRenameKubeConfig(t *testing.T) {
+	out, err := renameKubeConfig([]byte(testK3sKubeConfig), "default", "my-cluster")
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	var kubecfg struct {
+		Clusters []struct {
+			Name    string `yaml:"name"`
+			Cluster struct {
+				CA string `yaml:"certificate-authority-data"`
+			} `yaml:"cluster"`
+		} `yaml:"clusters"`
+		Contexts []struct {
+			Name    string `yaml:"name"`
+			Context struct {
+				Cluster   string `yaml:"cluster"`
+				Namespace string `yaml:"namespace"`
+				User      string `yaml:"user"`
+			} `yaml:"context"`
+		} `yaml:"contexts"`
+		CurrentContext string `yaml:"current-context"`
+		Users          []struct {
+			Name string `yaml:"name"`
+			User struct {
+				Cert  string `yaml:"client-certificate-data"`
+				Token string `yaml:"token"`
+			} `yaml:"user"`
+		} `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(out, &kubecfg); err != nil {
+		t.Fatalf("failed to parse renamed kubeconfig, %v", err)
+	}
+	if len(kubecfg.Clusters) != 1 || len(kubecfg.Contexts) != 1 || len(kubecfg.Users) != 1 {
+		t.Fatalf("got %d clusters, %d contexts and %d users, want one of each",
+			len(kubecfg.Clusters), len(kubecfg.Contexts), len(kubecfg.Users))
+	}
+
+	tests := []struct{ field, got, want string }{
+		{"clusters[].name", kubecfg.Clusters[0].Name, "my-cluster"},
+		{"contexts[].name", kubecfg.Contexts[0].Name, "my-cluster"},
+		{"contexts[].context.cluster", kubecfg.Contexts[0].Context.Cluster, "my-cluster"},
+		{"contexts[].context.user", kubecfg.Contexts[0].Context.User, "my-cluster"},
+		{"users[].name", kubecfg.Users[0].Name, "my-cluster"},
+		{"current-context", kubecfg.CurrentContext, "my-cluster"},
+		{"contexts[].context.namespace", kubecfg.Contexts[0].Context.Namespace, "default"},
+		{"clusters[].cluster.certificate-authority-data", kubecfg.Clusters[0].Cluster.CA, "ZGVmYXVsdA=="},
+		{"users[].user.client-certificate-data", kubecfg.Users[0].User.Cert, "ZGVmYXVsdA=="},
+		{"users[].user.token", kubecfg.Users[0].User.Token, "default-token-x7f2k"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s is %q, want %q", tt.field, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// rootVolume is the root EBS volume of the instances of a node role
+type rootVolume struct {
+	size       int32
+	volumeType string
+	iops       int32
+	throughput int32
+	encrypted  bool
+	kmsKeyID   string
+}
+
+// describeRootDevice returns the root device name and architecture of the AMI with id and
+// the size in GiB of its root snapshot, the smallest root volume it can be launched with
+func describeRootDevice(client *ec2.Client, id string) (device, arch string, minSize int32, err error) {
+	result, err := client.DescribeImages(context.TODO(), &ec2.DescribeImagesInput{ImageIds: []string{id}})
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to describe AMI %q, %v", id, err)
+	}
+	if len(result.Images) == 0 || result.Images[0].RootDeviceName == nil {
+		return "", "", 0, fmt.Errorf("AMI %q has no root device", id)
+	}
+
+	image := result.Images[0]
+	device = *image.RootDeviceName
+	for _, v := range image.BlockDeviceMappings {
+		if aws.ToString(v.DeviceName) == device && v.Ebs != nil {
+			minSize = aws.ToInt32(v.Ebs.VolumeSize)
+		}
+	}
+	return device, string(image.Architecture), minSize, nil
+}
+
+// valRootVolumes validates that the root volume of every role fits the root snapshot of the
+// AMI, which is minSize GiB
+func valRootVolumes(k3scfg *cfg, idAMI string, minSize int32) error {
+	for _, role := range []string{"bastion", "server", "worker"} {
+		if v := k3scfg.rootVolumes[role]; v.size < minSize {
+			return fmt.Errorf("the %d GiB %s root volume is smaller than the %d GiB root snapshot of AMI %q", v.size, role, minSize, idAMI)
+		}
+	}
+	return nil
+}
+
+// rootVolumeMappings returns the block device mapping of the root volume of role on the AMI
+// of arch, or nil to keep the AMI default if the root device of the AMI isn't known
+func rootVolumeMappings(k3scfg *cfg, role, arch string) []types.BlockDeviceMapping {
+	device := k3scfg.rootDevices[arch]
+	if device == "" {
+		return nil
+	}
+
+	v := k3scfg.rootVolumes[role]
+	ebs := &types.EbsBlockDevice{
+		DeleteOnTermination: aws.Bool(true),
+		Encrypted:           aws.Bool(v.encrypted),
+		VolumeSize:          aws.Int32(v.size),
+		VolumeType:          types.VolumeType(v.volumeType),
+	}
+	if v.iops > 0 {
+		ebs.Iops = aws.Int32(v.iops)
+	}
+	if v.throughput > 0 {
+		ebs.Throughput = aws.Int32(v.throughput)
+	}
+	if v.kmsKeyID != "" {
+		ebs.KmsKeyId = aws.String(v.kmsKeyID)
+	}
+
+	return []types.BlockDeviceMapping{
+		{
+			DeviceName: &device,
+			Ebs:        ebs,
+		},
+	}
+}
+
+// volumeTagSpecs returns the tag specification tagging the volumes of the instance called name
+// at launch so a volume left behind can be traced to its cluster
+func volumeTagSpecs(k3scfg *cfg, name string) []types.TagSpecification {
+	return []types.TagSpecification{
+		{
+			ResourceType: types.ResourceTypeVolume,
+			Tags:         clusterTags(k3scfg, name),
+		},
+	}
+}
+
+// describeRootVolumes returns the root volume of each of instances keyed by instance id
+func describeRootVolumes(client *ec2.Client, instances map[string]types.Instance) (map[string]types.Volume, error) {
+	rootVolumeIDs := map[string]string{}
+	var ids []string
+	for id, v := range instances {
+		for _, m := range v.BlockDeviceMappings {
+			if m.Ebs != nil && aws.ToString(m.DeviceName) == aws.ToString(v.RootDeviceName) {
+				rootVolumeIDs[*m.Ebs.VolumeId] = id
+				ids = append(ids, *m.Ebs.VolumeId)
+			}
+		}
+	}
+
+	volumes := map[string]types.Volume{}
+	if len(ids) == 0 {
+		return volumes, nil
+	}
+
+	var volumeID = "volume-id"
+	paginator := ec2.NewDescribeVolumesPaginator(client, &ec2.DescribeVolumesInput{
+		Filters: []types.Filter{
+			{
+				Name:   &volumeID,
+				Values: ids,
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe volumes, %v", err)
+		}
+		for _, v := range result.Volumes {
+			volumes[rootVolumeIDs[*v.VolumeId]] = v
+		}
+	}
+	return volumes, nil
+}
+
+// formatVolume formats a volume for status, e.g. "20GiB gp3 3000/125 encrypted"
+func formatVolume(v types.Volume) string {
+	if v.VolumeId == nil {
+		return "-"
+	}
+	s := fmt.Sprintf("%dGiB %s", aws.ToInt32(v.Size), v.VolumeType)
+	if v.Iops != nil {
+		s += fmt.Sprintf(" %d", *v.Iops)
+		if v.Throughput != nil {
+			s += fmt.Sprintf("/%d", *v.Throughput)
+		}
+	}
+	if aws.ToBool(v.Encrypted) {
+		s += " encrypted"
+	}
+	return s
+}
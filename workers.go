@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultParallelism is the number of workers launched at the same time when not set
+const defaultParallelism = 5
+
+// nodeJob is a server or worker instance to launch with its Name tag, role, subnet,
+// architecture, instance type, worker group and user data
+type nodeJob struct {
+	name         string
+	role         string
+	subnet       string
+	arch         string
+	instanceType string
+	group        string
+	userData     string
+}
+
+// workerGroup is a set of workers sharing an architecture and instance type. The group of a
+// spec without worker groups has no name.
+type workerGroup struct {
+	name         string
+	count        int32
+	arch         string
+	instanceType string
+}
+
+// planNodes returns the servers after the main and the workers of every worker group, spread
+// over subnets after the main, without their user data which needs the main
+func planNodes(k3scfg *cfg, subnets []string) (servers, workers []nodeJob) {
+	for i := 1; i < int(k3scfg.servers); i++ {
+		servers = append(servers, nodeJob{
+			name:         serverName(k3scfg, i),
+			role:         "server",
+			subnet:       subnets[i%len(subnets)],
+			arch:         k3scfg.arch,
+			instanceType: k3scfg.serverType,
+		})
+	}
+
+	// workers are numbered across groups so their names don't depend on the group layout
+	i := 1
+	for _, g := range k3scfg.workerGroups {
+		for j := int32(0); j < g.count; j++ {
+			workers = append(workers, nodeJob{
+				name:         workerName(k3scfg, i),
+				role:         "worker",
+				subnet:       subnets[(int(k3scfg.servers)+i-1)%len(subnets)],
+				arch:         g.arch,
+				instanceType: g.instanceType,
+				group:        g.name,
+			})
+			i++
+		}
+	}
+	return servers, workers
+}
+
+// multiError aggregates the errors of jobs that ran concurrently
+type multiError []error
+
+// Error implements error, listing every error on its own line
+func (m multiError) Error() string {
+	msgs := make([]string, 0, len(m))
+	for _, v := range m {
+		msgs = append(msgs, v.Error())
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("%d errors occurred:\n  - %s", len(m), strings.Join(msgs, "\n  - "))
+}
+
+// launchNode creates a single server or worker instance. Workers are spot instances
+// when k3scfg.spotWorkers is set, falling back to on-demand if there is no spot capacity and
+// k3scfg.spotFallback is set. The instance is launched from the AMI of its architecture.
+func launchNode(client *ec2.Client, k3scfg *cfg, job nodeJob, idSG string) (types.Instance, error) {
+	// use one for min and max since we want to create one instance at a time in each subnet
+	one := int32(1)
+	idAMI := k3scfg.amis[job.arch]
+
+	runInput := &ec2.RunInstancesInput{
+		ImageId:             &idAMI,
+		InstanceType:        types.InstanceType(job.instanceType),
+		KeyName:             &k3scfg.key,
+		MinCount:            &one,
+		MaxCount:            &one,
+		SecurityGroupIds:    []string{idSG},
+		SubnetId:            &job.subnet,
+		UserData:            b64(job.userData),
+		BlockDeviceMappings: rootVolumeMappings(k3scfg, job.role, job.arch),
+		TagSpecifications:   launchTagSpecs(k3scfg, job.name, idAMI),
+	}
+	spot := job.role == "worker" && k3scfg.spotWorkers
+	if spot {
+		runInput.InstanceMarketOptions = spotMarketOptions(k3scfg)
+	}
+
+	// Build the request with its input parameters
+	result, err := client.RunInstances(context.TODO(), runInput)
+	if err != nil && spot && k3scfg.spotFallback && isSpotCapacityError(err) {
+		log.Printf("%s: no spot capacity, launching on-demand instead, %v", job.name, err)
+		runInput.InstanceMarketOptions = nil
+		result, err = client.RunInstances(context.TODO(), runInput)
+	}
+	if err != nil {
+		return types.Instance{}, fmt.Errorf("%s: failed to create instance, %v", job.name, err)
+	}
+	k3scfg.state.addInstance(result.Instances[0], job.name, job.role)
+
+	return result.Instances[0], nil
+}
+
+// launchNodes launches the node jobs with at most k3scfg.parallelism in flight, logging
+// progress as each one finishes and returning the errors of every failed job
+func launchNodes(client *ec2.Client, k3scfg *cfg, jobs []nodeJob, idSG string) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	parallelism := k3scfg.parallelism
+	if parallelism < 1 {
+		parallelism = defaultParallelism
+	}
+	if parallelism > len(jobs) {
+		parallelism = len(jobs)
+	}
+	log.Printf("Launching %d %ss, %d at a time.\n", len(jobs), jobs[0].role, parallelism)
+
+	queue := make(chan nodeJob)
+	var mu sync.Mutex
+	var errs multiError
+	done := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				instance, err := launchNode(client, k3scfg, job, idSG)
+
+				mu.Lock()
+				done++
+				if err != nil {
+					errs = append(errs, err)
+					log.Printf("[%d/%d] Failed %s %q, %v\n", done, len(jobs), job.role, job.name, err)
+				} else {
+					log.Printf("[%d/%d] Created %s %q with ID: %q - PrivateIP: %q - Subnet: %q\n", done, len(jobs), job.role, job.name, *instance.InstanceId, *instance.PrivateIpAddress, job.subnet)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// stop handing out jobs once interrupted, the ones in flight still finish
+	for _, job := range jobs {
+		if checkInterrupted() != nil {
+			break
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return checkInterrupted()
+}